@@ -1,6 +1,6 @@
 module github.com/Volumental/jsontemplate
 
-go 1.13
+go 1.16
 
 require (
 	github.com/alecthomas/participle v0.3.0
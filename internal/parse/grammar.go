@@ -1,65 +1,370 @@
 package parse
 
 import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
 	"github.com/alecthomas/participle"
 	"github.com/alecthomas/participle/lexer"
 	"github.com/alecthomas/participle/lexer/ebnf"
 )
 
 type Generator struct {
-	Range       string `"range" @JSONPath`
-	SubTemplate Value  `"[" @@ "]"`
+	Group       bool            `("range" | @"group")`
+	Key         string          `((@Variable ",")?`
+	Variable    string          `@Variable "in")?`
+	Range       string          `@(JSONPath | Variable)`
+	By          *Expression     `("by" @@)?`
+	Where       *Expression     `("where" @@)?`
+	OrderBy     []Ordering      `("order" "by" @@ ("," @@)*)?`
+	Limit       *Expression     `("limit" @@)?`
+	Offset      *Expression     `("offset" @@)?`
+	SubTemplate Expression      `( "[" @@ "]"`
+	Members     *MemberTemplate `| @@ )`
+}
+
+// Ordering is a key to sort the elements of a generator by.
+type Ordering struct {
+	Key        Expression `@@`
+	Descending bool       `(@"desc" | "asc")?`
+}
+
+type MemberTemplate struct {
+	Key   Expression `"{" @@ ":"`
+	Value Expression `@@ "}"`
 }
 
 type AnnotatedField struct {
-	Annotation string `("@" @Ident)?`
-	Key        string `@String ":"`
-	Value      Value  `@@`
+	Spread      bool        `( @"..."`
+	Annotation  string      `| ("@" @Ident)?`
+	Key         string      `( @String`
+	ComputedKey *Expression `| "[" @@ "]" ) ":" )`
+	Value       Expression  `@@`
+}
+
+type Element struct {
+	Spread bool       `@"..."?`
+	Value  Expression `@@`
 }
 
 type Object struct {
 	Fields []AnnotatedField `"{" (@@ ("," @@)* ","?)? "}"`
 }
 
+type Conditional struct {
+	Condition Expression `"if" @@`
+	Then      Expression `"then" @@`
+	Else      Expression `"else" @@`
+}
+
+// Match chooses between several values depending on which pattern is equal to
+// a value. The arm with the pattern `_` is chosen if no other pattern matches.
+type Match struct {
+	Value Expression `"match" @@ "{"`
+	Arms  []Arm      `(@@ ("," @@)* ","?)? "}"`
+}
+
+type Arm struct {
+	Default bool        `( @"_"`
+	Pattern *Expression `| @@ ) ":"`
+	Value   Expression  `@@`
+}
+
+type Binding struct {
+	Name  string     `@Variable "="`
+	Value Expression `@@`
+}
+
+type Let struct {
+	Bindings []Binding  `"let" @@ ("," @@)*`
+	Body     Expression `"in" @@`
+}
+
+// Lambda is a sub-template that can be passed to a function, which may then
+// evaluate it with arguments of its choosing.
+type Lambda struct {
+	Params Params     `@@`
+	Body   Expression `@@`
+}
+
+// Params are the parameters of a lambda, followed by an arrow. A single
+// parameter can be written without parentheses, as in `$x => ...`, while other
+// lists are enclosed in them, as in `($acc, $x) => ...`. These are parsed by
+// hand, as telling `($x) => ...` from a parenthesized expression like `($x)`
+// requires more lookahead than the rest of the grammar.
+type Params struct {
+	Names []string
+}
+
+func (p *Params) Parse(l lexer.PeekingLexer) error {
+	var symbols = lex.Symbols()
+	var n = 0
+	var next = func(typ, value string) (lexer.Token, bool) {
+		var tok, err = l.Peek(n)
+		if err != nil || tok.Type != symbols[typ] || (value != "" && tok.Value != value) {
+			return tok, false
+		}
+		n++
+		return tok, true
+	}
+	var params []string
+	if tok, ok := next("Variable", ""); ok {
+		params = append(params, tok.Value)
+	} else if _, ok := next("Punct", "("); !ok {
+		return participle.NextMatch
+	} else if _, ok := next("Punct", ")"); !ok {
+		for {
+			var tok, ok = next("Variable", "")
+			if !ok {
+				return participle.NextMatch
+			}
+			params = append(params, tok.Value)
+			if _, ok := next("Punct", ")"); ok {
+				break
+			} else if _, ok := next("Punct", ","); !ok {
+				return participle.NextMatch
+			}
+		}
+	}
+	if _, ok := next("Operator", "=>"); !ok {
+		return participle.NextMatch
+	}
+	for ; n > 0; n-- {
+		l.Next()
+	}
+	p.Names = params
+	return nil
+}
+
+// Include is a reference to a template definition in another file.
+type Include struct {
+	Pos  lexer.Position
+	Path string `"include" @String`
+}
+
+// TemplateString is a string literal with embedded values, written within
+// backticks with each value enclosed in `${` and `}`.
+type TemplateString struct {
+	Parts  []string // The literal text around the values.
+	Values []Expression
+}
+
+func (t *TemplateString) Capture(values []string) error {
+	var s = values[0]
+	s = s[1 : len(s)-1] // Remove the backticks.
+	var part strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && strings.IndexByte("`$\\", s[i+1]) >= 0:
+			i++
+			part.WriteByte(s[i])
+		case strings.HasPrefix(s[i:], "${"):
+			var end = placeholderEnd(s, i+2)
+			if end < 0 {
+				return fmt.Errorf("unterminated placeholder in template string: %s", values[0])
+			}
+			var inner Template
+			if err := Parser.ParseString(s[i+2:end], &inner); err != nil {
+				return fmt.Errorf("invalid placeholder in template string: %v", err)
+			} else if len(inner.Definitions) > 0 {
+				return fmt.Errorf("definitions are not allowed in template string placeholders: %s", values[0])
+			} else if len(inner.Params) > 0 {
+				return fmt.Errorf("parameters are not allowed in template string placeholders: %s", values[0])
+			} else if containsInclude(reflect.ValueOf(inner.Root)) {
+				// Placeholders are parsed on their own, so the path of the
+				// file to resolve the include from is unknown.
+				return fmt.Errorf("includes are not allowed in template string placeholders: %s", values[0])
+			}
+			t.Parts = append(t.Parts, part.String())
+			t.Values = append(t.Values, inner.Root)
+			part.Reset()
+			i = end
+		default:
+			part.WriteByte(s[i])
+		}
+	}
+	t.Parts = append(t.Parts, part.String())
+	return nil
+}
+
+// containsInclude reports whether a node of the syntax tree has an include
+// anywhere within it.
+func containsInclude(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if _, ok := v.Interface().(*Include); ok && !v.IsNil() {
+			return true
+		}
+		return !v.IsNil() && containsInclude(v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if containsInclude(v.Field(i)) {
+				return true
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if containsInclude(v.Index(i)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// placeholderEnd finds the index of the brace closing a placeholder, skipping
+// over nested braces, string literals and quoted strings in queries. It returns
+// -1 if there is none.
+func placeholderEnd(s string, start int) int {
+	var depth = 0
+	for i := start; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\'':
+			for i++; i < len(s) && s[i] != c; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
 type Function struct {
-	Name string  `@Ident`
-	Args []Value `"(" (@@ ("," @@)*)? ")"`
+	Name string       `@Ident`
+	Args []Expression `"(" (@@ ("," @@)*)? ")"`
+}
+
+// Boolean is a boolean literal. A plain bool can't be used, as the parser sets
+// those to true on any match.
+type Boolean bool
+
+func (b *Boolean) Capture(values []string) error {
+	*b = values[0] == "true"
+	return nil
+}
+
+// Number is a number literal, as written to keep integers exact. Besides the
+// JSON grammar, a fraction may be written without a leading zero, as in `.5`.
+// The lexer can't backtrack, so it produces tokens such as "1." and "1e" when a
+// number is followed by something else. Those are rejected here.
+type Number string
+
+var numberPattern = regexp.MustCompile(`^((0|[1-9][0-9]*)(\.[0-9]+)?|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+
+func (n *Number) Capture(values []string) error {
+	if !numberPattern.MatchString(values[0]) {
+		return fmt.Errorf("invalid number %s", values[0])
+	}
+	*n = Number(values[0])
+	return nil
 }
 
 type Value struct {
 	// These are standard JSON fields.
-	String *string  `  @String`
-	Number *float64 `| @Number`
-	Object *Object  `| @@`
-	Array  []Value  `| "[" (@@ ("," @@)* ","?)? "]"`
-	Bool   *bool    `| (@"true" | "false")`
-	Null   bool     `| @"null"`
+	String *string   `  @String`
+	Number *Number   `| @Number`
+	Object *Object   `| @@`
+	Empty  bool      `| "[" @"]"` // An empty array.
+	Array  []Element `| "[" (@@ ("," @@)* ","?)? "]"`
+	Bool   *Boolean  `| @("true" | "false")`
+	Null   bool      `| @"null"`
 
 	// These are template elements generating JSON fields.
-	Generator *Generator `| @@`
-	Extractor *string    `| @JSONPath`
-	Function  *Function  `| @@`
+	Generator     *Generator      `| @@`
+	Conditional   *Conditional    `| @@`
+	Match         *Match          `| @@`
+	Let           *Let            `| @@`
+	Include       *Include        `| @@`
+	Lambda        *Lambda         `| @@`
+	Interpolation *TemplateString `| @TemplateString`
+	Extractor     *string         `| @(JSONPath | Variable)`
+	Function      *Function       `| @@`
+
+	// A parenthesized expression.
+	Expression *Expression `| "(" @@ ")"`
+}
+
+// Operand is a value with any unary operators applied to it.
+type Operand struct {
+	Unary []string `{ @("-" | "!") }`
+	Value Value    `@@`
+}
+
+type Operation struct {
+	Operator string  `@("??" | "||" | "&&" | "==" | "!=" | "<=" | "<" | ">=" | ">" | "+" | "-" | "*" | "/" | "%")`
+	Operand  Operand `@@`
+}
+
+// Stage is a function applied to the value piped into it. The parentheses may
+// be omitted if there are no further arguments.
+type Stage struct {
+	Name string       `@Ident`
+	Args []Expression `[ "(" (@@ ("," @@)*)? ")" ]`
+}
+
+// Expression is a sequence of operands separated by binary operators. As the
+// precedence of the operators is not expressed in the grammar, it must be taken
+// into account by the consumer. The result may be piped through any number of
+// functions.
+type Expression struct {
+	Operand    Operand     `@@`
+	Operations []Operation `{ @@ }`
+	Pipeline   []Stage     `{ "|" @@ }`
+}
+
+// Definition is a named sub-template, which can be called like a function.
+type Definition struct {
+	Name   string     `"def" @Ident`
+	Params []string   `"(" (@Variable ("," @Variable)*)? ")"`
+	Body   Expression `@@`
+}
+
+// Param is a parameter of a template, supplied when it is rendered. It is
+// optional if it has a default value.
+type Param struct {
+	Name    string      `"param" @Ident`
+	Default *Expression `("=" @@)?`
 }
 
 type Template struct {
-	Root Value `@@`
+	Params      []Param      `{ @@ }`
+	Definitions []Definition `{ @@ }`
+	Root        Expression   `@@`
 }
 
 var lex = lexer.Must(ebnf.New(`
 	Comment = "#" { "\u0000"…"\uffff"-"\n" } .
 	Ident = (alpha | "_") { "_" | alpha | digit } .
 	String = "\"" { "\u0000"…"\uffff"-"\""-"\\" | "\\" any } "\"" .
-	Number = Int | Float .
-	Int = [ "-" ] digit { digit } .
-	Float = [ "-" ] [ digit ] "." digit { digit } .
-	JSONPath = "$" { "." { "." } JSONPathExpr } .
-	JSONPathExpr = "*" | (Ident { "[" { "\u0000"…"\uffff"-"]" } "]" }) .
+	TemplateString = ` + "\"`\"" + ` { "\u0000"…"\uffff"-` + "\"`\"" + `-"\\" | "\\" any } ` + "\"`\"" + ` .
+	Number = (integer [ fraction ] | fraction) [ exponent ] .
+	Variable = "$" Ident { segment } .
+	JSONPath = "$" { segment } .
+	Operator = "..." | "=" ("=" | ">") | "!" "=" | "<" "=" | ">" "=" | "&" "&" | "|" "|" | "?" "?" .
 	Punct = "!"…"/" | ":"…"@" | "["…` + "\"`\"" + ` | "{"…"~" .
 	Whitespace = " " | "\t" | "\n" | "\r" .
 
 	alpha = "a"…"z" | "A"…"Z" .
 	digit = "0"…"9" .
+	integer = "0" | "1"…"9" { digit } .
+	fraction = "." digit { digit } .
+	exponent = ("e" | "E") [ "+" | "-" ] digit { digit } .
 	any = "\u0000"…"\uffff" .
+	segment = "." { "." } [ "*" | key ] | index .
+	key = keychar { keychar } .
+	keychar = alpha | digit | "_" | "-" | "\u0080"…"\uffff" | "\\" any .
+	index = "[" { quoted | index | "\u0000"…"\uffff"-"["-"]"-"\""-"'" } "]" .
+	quoted = "\"" { "\u0000"…"\uffff"-"\""-"\\" | "\\" any } "\"" | "'" { "\u0000"…"\uffff"-"'"-"\\" | "\\" any } "'" .
 `))
 
 var Parser = participle.MustBuild(
@@ -7,10 +7,19 @@ import (
 	"testing"
 )
 
-func numberValue(f float64) Value          { return Value{Number: &f} }
-func stringValue(s string) Value           { return Value{String: &s} }
-func boolValue(b bool) Value               { return Value{Bool: &b} }
-func extractorValue(jsonPath string) Value { return Value{Extractor: &jsonPath} }
+func value(v Value) Expression                  { return Expression{Operand: Operand{Value: v}} }
+func numberValue(s string) Expression           { return value(Value{Number: (*Number)(&s)}) }
+func stringValue(s string) Expression           { return value(Value{String: &s}) }
+func boolValue(b bool) Expression               { return value(Value{Bool: (*Boolean)(&b)}) }
+func extractorValue(jsonPath string) Expression { return value(Value{Extractor: &jsonPath}) }
+
+func elements(values ...Expression) []Element {
+	var res = make([]Element, len(values))
+	for i, v := range values {
+		res[i] = Element{Value: v}
+	}
+	return res
+}
 
 func TestTextRenderer_Render(t *testing.T) {
 	tests := []struct {
@@ -28,9 +37,39 @@ func TestTextRenderer_Render(t *testing.T) {
 			name:       "number",
 			definition: "1",
 			wantOut: Template{
-				Root: numberValue(1),
+				Root: numberValue("1"),
 			},
 		},
+		{
+			name:       "numbers",
+			definition: `[0, 1.5, .5, 1e6, 2.5E-3, 10e+2, 9007199254740993]`,
+			wantOut: Template{
+				Root: value(Value{Array: elements(
+					numberValue("0"),
+					numberValue("1.5"),
+					numberValue(".5"),
+					numberValue("1e6"),
+					numberValue("2.5E-3"),
+					numberValue("10e+2"),
+					numberValue("9007199254740993"),
+				)}),
+			},
+		},
+		{
+			name:       "number with trailing point",
+			definition: `[5.]`,
+			wantErr:    true,
+		},
+		{
+			name:       "number with point before exponent",
+			definition: `[1.e5]`,
+			wantErr:    true,
+		},
+		{
+			name:       "number with empty exponent",
+			definition: `[1e]`,
+			wantErr:    true,
+		},
 		{
 			name:       "string",
 			definition: `"foo"`,
@@ -42,12 +81,22 @@ func TestTextRenderer_Render(t *testing.T) {
 			name:       "array",
 			definition: `[1, 2, true, "foo"]`,
 			wantOut: Template{
-				Root: Value{Array: []Value{
-					numberValue(1),
-					numberValue(2),
+				Root: value(Value{Array: elements(
+					numberValue("1"),
+					numberValue("2"),
 					boolValue(true),
 					stringValue("foo"),
-				}},
+				)}),
+			},
+		},
+		{
+			name:       "empty array and false",
+			definition: `[[], false]`,
+			wantOut: Template{
+				Root: value(Value{Array: elements(
+					value(Value{Empty: true}),
+					boolValue(false),
+				)}),
 			},
 		},
 		{
@@ -59,7 +108,7 @@ func TestTextRenderer_Render(t *testing.T) {
 				}
 			`,
 			wantOut: Template{
-				Root: Value{Object: &Object{
+				Root: value(Value{Object: &Object{
 					Fields: []AnnotatedField{
 						{
 							Key:   "foo",
@@ -67,30 +116,328 @@ func TestTextRenderer_Render(t *testing.T) {
 						},
 						{
 							Key:   "bar",
-							Value: numberValue(123),
+							Value: numberValue("123"),
 						},
 					},
-				}},
+				}}),
 			},
 		},
 		{
 			name:       "function",
 			definition: `compare("foo", "bar")`,
 			wantOut: Template{
-				Root: Value{Function: &Function{
+				Root: value(Value{Function: &Function{
 					Name: "compare",
-					Args: []Value{
+					Args: []Expression{
 						stringValue("foo"),
 						stringValue("bar"),
 					},
-				}},
+				}}),
+			},
+		},
+		{
+			name:       "conditional",
+			definition: `if $.foo then "yes" else 123`,
+			wantOut: Template{
+				Root: value(Value{Conditional: &Conditional{
+					Condition: extractorValue("$.foo"),
+					Then:      stringValue("yes"),
+					Else:      numberValue("123"),
+				}}),
+			},
+		},
+		{
+			name:       "match",
+			definition: `match $.type { "a": 1, _: 2 }`,
+			wantOut: Template{
+				Root: value(Value{Match: &Match{
+					Value: extractorValue("$.type"),
+					Arms: []Arm{
+						{Pattern: &Expression{Operand: stringValue("a").Operand}, Value: numberValue("1")},
+						{Default: true, Value: numberValue("2")},
+					},
+				}}),
+			},
+		},
+		{
+			name:       "let",
+			definition: `let $x = $.foo, $y = $x[0].bar in [$x, $y.baz]`,
+			wantOut: Template{
+				Root: value(Value{Let: &Let{
+					Bindings: []Binding{
+						{Name: "$x", Value: extractorValue("$.foo")},
+						{Name: "$y", Value: extractorValue("$x[0].bar")},
+					},
+					Body: value(Value{Array: elements(
+						extractorValue("$x"),
+						extractorValue("$y.baz"),
+					)}),
+				}}),
+			},
+		},
+		{
+			name:       "generator variable",
+			definition: `range $x in $root.foo[*] [$x.bar]`,
+			wantOut: Template{
+				Root: value(Value{Generator: &Generator{
+					Variable:    "$x",
+					Range:       "$root.foo[*]",
+					SubTemplate: extractorValue("$x.bar"),
+				}}),
+			},
+		},
+		{
+			name:       "generator key",
+			definition: `range $i, $x in $.foo[*] [$i]`,
+			wantOut: Template{
+				Root: value(Value{Generator: &Generator{
+					Key:         "$i",
+					Variable:    "$x",
+					Range:       "$.foo[*]",
+					SubTemplate: extractorValue("$i"),
+				}}),
+			},
+		},
+		{
+			name:       "generator clauses",
+			definition: `range $.foo[*] where $.ok order by $.a desc, $.b asc, $.c limit 2 offset 1 [$]`,
+			wantOut: Template{
+				Root: value(Value{Generator: &Generator{
+					Range: "$.foo[*]",
+					Where: &Expression{Operand: extractorValue("$.ok").Operand},
+					OrderBy: []Ordering{
+						{Key: extractorValue("$.a"), Descending: true},
+						{Key: extractorValue("$.b")},
+						{Key: extractorValue("$.c")},
+					},
+					Limit:       &Expression{Operand: numberValue("2").Operand},
+					Offset:      &Expression{Operand: numberValue("1").Operand},
+					SubTemplate: extractorValue("$"),
+				}}),
+			},
+		},
+		{
+			name:       "group generator",
+			definition: `group $k, $g in $.foo[*] by $.category [$k]`,
+			wantOut: Template{
+				Root: value(Value{Generator: &Generator{
+					Group:       true,
+					Key:         "$k",
+					Variable:    "$g",
+					Range:       "$.foo[*]",
+					By:          &Expression{Operand: extractorValue("$.category").Operand},
+					SubTemplate: extractorValue("$k"),
+				}}),
+			},
+		},
+		{
+			name:       "object generator",
+			definition: `range $.foo[*] { $.id: $.bar }`,
+			wantOut: Template{
+				Root: value(Value{Generator: &Generator{
+					Range: "$.foo[*]",
+					Members: &MemberTemplate{
+						Key:   extractorValue("$.id"),
+						Value: extractorValue("$.bar"),
+					},
+				}}),
+			},
+		},
+		{
+			name:       "spread",
+			definition: `{...$.foo, "bar": [...$.bar, 1]}`,
+			wantOut: Template{
+				Root: value(Value{Object: &Object{
+					Fields: []AnnotatedField{
+						{
+							Spread: true,
+							Value:  extractorValue("$.foo"),
+						},
+						{
+							Key: "bar",
+							Value: value(Value{Array: []Element{
+								{Spread: true, Value: extractorValue("$.bar")},
+								{Value: numberValue("1")},
+							}}),
+						},
+					},
+				}}),
+			},
+		},
+		{
+			name:       "template string",
+			definition: "`id ${$.id}: ${ {\"a\": \"}\"} }\\${x}`",
+			wantOut: Template{
+				Root: value(Value{Interpolation: &TemplateString{
+					Parts: []string{"id ", ": ", "${x}"},
+					Values: []Expression{
+						extractorValue("$.id"),
+						value(Value{Object: &Object{Fields: []AnnotatedField{
+							{Key: "a", Value: stringValue("}")},
+						}}}),
+					},
+				}}),
+			},
+		},
+		{
+			name:       "template string with quoted query",
+			definition: "`${$.a[?(@.b=='}')].c}`",
+			wantOut: Template{
+				Root: value(Value{Interpolation: &TemplateString{
+					Parts:  []string{"", ""},
+					Values: []Expression{extractorValue("$.a[?(@.b=='}')].c")},
+				}}),
+			},
+		},
+		{
+			name:       "template string with include",
+			definition: "`${[1, include \"a.tmpl\"]}`",
+			wantErr:    true,
+		},
+		{
+			name:       "unterminated template string placeholder",
+			definition: "`${$.id`",
+			wantErr:    true,
+		},
+		{
+			name:       "operators",
+			definition: `-1 + 2 * -(3 - $.foo)`,
+			wantOut: Template{
+				Root: Expression{
+					Operand: Operand{Unary: []string{"-"}, Value: numberValue("1").Operand.Value},
+					Operations: []Operation{
+						{Operator: "+", Operand: numberValue("2").Operand},
+						{Operator: "*", Operand: Operand{
+							Unary: []string{"-"},
+							Value: Value{Expression: &Expression{
+								Operand: numberValue("3").Operand,
+								Operations: []Operation{
+									{Operator: "-", Operand: extractorValue("$.foo").Operand},
+								},
+							}},
+						}},
+					},
+				},
+			},
+		},
+		{
+			name:       "boolean operators",
+			definition: `!$.a || $.b >= 2`,
+			wantOut: Template{
+				Root: Expression{
+					Operand: Operand{Unary: []string{"!"}, Value: extractorValue("$.a").Operand.Value},
+					Operations: []Operation{
+						{Operator: "||", Operand: extractorValue("$.b").Operand},
+						{Operator: ">=", Operand: numberValue("2").Operand},
+					},
+				},
+			},
+		},
+		{
+			name:       "pipeline",
+			definition: `$.a + 1 | foo("bar") | baz`,
+			wantOut: Template{
+				Root: Expression{
+					Operand: extractorValue("$.a").Operand,
+					Operations: []Operation{
+						{Operator: "+", Operand: numberValue("1").Operand},
+					},
+					Pipeline: []Stage{
+						{Name: "foo", Args: []Expression{stringValue("bar")}},
+						{Name: "baz"},
+					},
+				},
+			},
+		},
+		{
+			name:       "definitions",
+			definition: `def foo($a, $b) [$a, $b] def bar() 1 foo(bar(), 2)`,
+			wantOut: Template{
+				Definitions: []Definition{
+					{
+						Name:   "foo",
+						Params: []string{"$a", "$b"},
+						Body:   value(Value{Array: elements(extractorValue("$a"), extractorValue("$b"))}),
+					},
+					{Name: "bar", Body: numberValue("1")},
+				},
+				Root: value(Value{Function: &Function{
+					Name: "foo",
+					Args: []Expression{
+						value(Value{Function: &Function{Name: "bar"}}),
+						numberValue("2"),
+					},
+				}}),
+			},
+		},
+		{
+			name:       "params",
+			definition: `param tenant param locale = "en" def f() 1 $params.tenant`,
+			wantOut: Template{
+				Params: []Param{
+					{Name: "tenant"},
+					{Name: "locale", Default: &Expression{Operand: stringValue("en").Operand}},
+				},
+				Definitions: []Definition{{Name: "f", Body: numberValue("1")}},
+				Root:        extractorValue("$params.tenant"),
+			},
+		},
+		{
+			name:       "computed key",
+			definition: `{@foo [$.locale]: $.text}`,
+			wantOut: Template{
+				Root: value(Value{Object: &Object{
+					Fields: []AnnotatedField{
+						{
+							Annotation: "foo",
+							ComputedKey: &Expression{
+								Operand: extractorValue("$.locale").Operand,
+							},
+							Value: extractorValue("$.text"),
+						},
+					},
+				}}),
+			},
+		},
+		{
+			name:       "lambdas",
+			definition: `f($x => $x.a, ($a, $b) => $a, () => 1, ($.c))`,
+			wantOut: Template{
+				Root: value(Value{Function: &Function{
+					Name: "f",
+					Args: []Expression{
+						value(Value{Lambda: &Lambda{
+							Params: Params{Names: []string{"$x"}},
+							Body:   extractorValue("$x.a"),
+						}}),
+						value(Value{Lambda: &Lambda{
+							Params: Params{Names: []string{"$a", "$b"}},
+							Body:   extractorValue("$a"),
+						}}),
+						value(Value{Lambda: &Lambda{
+							Body: numberValue("1"),
+						}}),
+						value(Value{Expression: &Expression{
+							Operand: extractorValue("$.c").Operand,
+						}}),
+					},
+				}}),
+			},
+		},
+		{
+			name:       "parenthesized variable",
+			definition: `($x)`,
+			wantOut: Template{
+				Root: value(Value{Expression: &Expression{
+					Operand: extractorValue("$x").Operand,
+				}}),
 			},
 		},
 		{
 			name:       "annotation",
 			definition: `{@foobar "foo": true}`,
 			wantOut: Template{
-				Root: Value{Object: &Object{
+				Root: value(Value{Object: &Object{
 					Fields: []AnnotatedField{
 						{
 							Annotation: "foobar",
@@ -98,21 +445,40 @@ func TestTextRenderer_Render(t *testing.T) {
 							Value:      boolValue(true),
 						},
 					},
-				}},
+				}}),
 			},
 		},
 		{
 			name:       "jsonpath",
 			definition: `{"foo": $.foo.bar[234]..baz[*]}`,
 			wantOut: Template{
-				Root: Value{Object: &Object{
+				Root: value(Value{Object: &Object{
 					Fields: []AnnotatedField{
 						{
 							Key:   "foo",
 							Value: extractorValue("$.foo.bar[234]..baz[*]"),
 						},
 					},
-				}},
+				}}),
+			},
+		},
+		{
+			name:       "jsonpath brackets and keys",
+			definition: `[$["content-type"], $[0], $.h.x-request-id, $['x y'], $.städte, $.a[?(@.n == "a]b")].v, $x['a\'b'], $.n - 1]`,
+			wantOut: Template{
+				Root: value(Value{Array: []Element{
+					{Value: extractorValue(`$["content-type"]`)},
+					{Value: extractorValue(`$[0]`)},
+					{Value: extractorValue(`$.h.x-request-id`)},
+					{Value: extractorValue(`$['x y']`)},
+					{Value: extractorValue(`$.städte`)},
+					{Value: extractorValue(`$.a[?(@.n == "a]b")].v`)},
+					{Value: extractorValue(`$x['a\'b']`)},
+					{Value: Expression{
+						Operand:    extractorValue("$.n").Operand,
+						Operations: []Operation{{Operator: "-", Operand: numberValue("1").Operand}},
+					}},
+				}}),
 			},
 		},
 		{
@@ -134,46 +500,46 @@ func TestTextRenderer_Render(t *testing.T) {
 				}
 			`,
 			wantOut: Template{
-				Root: Value{Object: &Object{Fields: []AnnotatedField{
+				Root: value(Value{Object: &Object{Fields: []AnnotatedField{
 					{
 						Key: "foo",
-						Value: Value{
-							Array: []Value{
-								numberValue(123),
-								Value{
+						Value: value(Value{
+							Array: elements(
+								numberValue("123"),
+								value(Value{
 									Object: &Object{Fields: []AnnotatedField{
 										{
 											Annotation: "deprecated",
 											Key:        "baz",
-											Value: Value{
+											Value: value(Value{
 												Generator: &Generator{
 													Range: "$..stuff",
-													SubTemplate: Value{
+													SubTemplate: value(Value{
 														Object: &Object{Fields: []AnnotatedField{
 															{
 																Key:   "x",
-																Value: Value{Null: true},
+																Value: value(Value{Null: true}),
 															},
 															{
 																Key:   "y",
 																Value: extractorValue("$.hello[1:5]"),
 															},
 														}},
-													},
+													}),
 												},
-											},
+											}),
 										},
 										{
 											Key:   "something",
 											Value: stringValue("with trailing comma"),
 										},
 									}},
-								},
-							},
-						},
+								}),
+							),
+						}),
 					},
 				},
-				}},
+				}}),
 			},
 		},
 	}
@@ -0,0 +1,181 @@
+package jsontemplate
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// Object is a JSON object that keeps its members in the order they were
+// generated by the template. Render returns objects as Object values rather than
+// maps if the OrderedObjects field of the Template is set.
+type Object []Member
+
+// Member is a key and value in an Object.
+type Member struct {
+	Key   string
+	Value interface{}
+}
+
+// Get returns the value of the member with the given key, and whether there is
+// such a member.
+func (o Object) Get(key string) (interface{}, bool) {
+	for _, m := range o {
+		if m.Key == key {
+			return m.Value, true
+		}
+	}
+	return nil, false
+}
+
+// MarshalJSON encodes the object with its members in order.
+func (o Object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encode(&buf, o); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encode writes a value as JSON. Objects and arrays are written directly rather
+// than by the json package, which would validate the output of MarshalJSON once
+// for each level of nesting.
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case Object:
+		buf.WriteByte('{')
+		for i, m := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encode(buf, m.Key); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := encode(buf, m.Value); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		if v == nil {
+			buf.WriteString("null")
+			break
+		}
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encode(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		var text, err = json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(text)
+	}
+	return nil
+}
+
+// keyOrder records the order of the members of the objects generated while
+// rendering a template, which is lost in maps. Objects are identified by the
+// address of their map, and are kept alive by the record so that the address
+// can't be reused. A nil keyOrder records nothing.
+type keyOrder map[uintptr]orderedKeys
+
+type orderedKeys struct {
+	object map[string]interface{}
+	keys   []string
+}
+
+func (k keyOrder) record(object map[string]interface{}, keys []string) {
+	if k != nil {
+		k[reflect.ValueOf(object).Pointer()] = orderedKeys{object, keys}
+	}
+}
+
+// keys returns the keys of an object in the order they were generated. The keys
+// of other objects, such as those in the input data, are sorted. Functions may
+// have changed a generated object after it was recorded, so keys that are gone
+// are skipped, and keys that were added follow the generated ones in order.
+func (k keyOrder) keys(object map[string]interface{}) []string {
+	var keys = make([]string, 0, len(object))
+	var generated = make(map[string]bool)
+	for _, key := range k[reflect.ValueOf(object).Pointer()].keys {
+		if _, ok := object[key]; ok {
+			keys = append(keys, key)
+			generated[key] = true
+		}
+	}
+	if len(keys) == len(object) {
+		return keys
+	}
+	var n = len(keys)
+	for key := range object {
+		if !generated[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys[n:])
+	return keys
+}
+
+// members works like the function with the same name, but returns the members
+// of generated objects in the order they were generated.
+func (k keyOrder) members(v interface{}) (keys []interface{}, values []reflect.Value) {
+	var object, ok = v.(map[string]interface{})
+	if !ok || k == nil {
+		return members(reflect.ValueOf(v))
+	}
+	var obj = reflect.ValueOf(object)
+	keys = make([]interface{}, 0, len(object))
+	for _, key := range k.keys(object) {
+		keys = append(keys, key)
+		values = append(values, obj.MapIndex(reflect.ValueOf(key)))
+	}
+	return keys, values
+}
+
+// marshal encodes a rendered value as JSON, with the members of generated
+// objects in the order they were generated.
+func (k keyOrder) marshal(v interface{}) ([]byte, error) {
+	if k == nil {
+		return json.Marshal(v)
+	}
+	var buf bytes.Buffer
+	if err := encode(&buf, k.ordered(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ordered returns a copy of a rendered value, with its objects converted to
+// Object values.
+func (k keyOrder) ordered(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		var keys = k.keys(v)
+		var res = make(Object, len(keys))
+		for i, key := range keys {
+			res[i] = Member{Key: key, Value: k.ordered(v[key])}
+		}
+		return res
+	case []interface{}:
+		if v == nil {
+			return v
+		}
+		var res = make([]interface{}, len(v))
+		for i, e := range v {
+			res[i] = k.ordered(e)
+		}
+		return res
+	default:
+		return v
+	}
+}
@@ -0,0 +1,81 @@
+package jsontemplate
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestObject_Get(t *testing.T) {
+	var o = Object{{Key: "b", Value: 1}, {Key: "a", Value: nil}}
+	tests := []struct {
+		key    string
+		want   interface{}
+		wantOk bool
+	}{
+		{key: "b", want: 1, wantOk: true},
+		{key: "a", want: nil, wantOk: true},
+		{key: "c", want: nil, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got, ok := o.Get(tt.key); got != tt.want || ok != tt.wantOk {
+				t.Errorf("Object.Get() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestObject_MarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		o    Object
+		want string
+	}{
+		{
+			name: "empty",
+			o:    nil,
+			want: `{}`,
+		},
+		{
+			name: "ordered",
+			o:    Object{{Key: "z", Value: 1}, {Key: "a", Value: "v"}},
+			want: `{"z":1,"a":"v"}`,
+		},
+		{
+			name: "nested",
+			o: Object{
+				{Key: "y", Value: []interface{}{Object{{Key: "b", Value: nil}, {Key: "a", Value: true}}}},
+				{Key: "x", Value: map[string]interface{}{"d": 1, "c": 2}},
+			},
+			want: `{"y":[{"b":null,"a":true}],"x":{"c":2,"d":1}}`,
+		},
+		{
+			name: "nil array",
+			o:    Object{{Key: "a", Value: []interface{}(nil)}, {Key: "b", Value: []interface{}{}}},
+			want: `{"a":null,"b":[]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(tt.o)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("Object.MarshalJSON() = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func Test_keyOrder_ordered(t *testing.T) {
+	var order = keyOrder{}
+	var generated = map[string]interface{}{"b": 1, "a": 2}
+	order.record(generated, []string{"b", "a"})
+	var input = map[string]interface{}{"d": generated, "c": []interface{}{generated}}
+	var want = Object{
+		{Key: "c", Value: []interface{}{Object{{Key: "b", Value: 1}, {Key: "a", Value: 2}}}},
+		{Key: "d", Value: Object{{Key: "b", Value: 1}, {Key: "a", Value: 2}}},
+	}
+	if got := order.ordered(input); !reflect.DeepEqual(got, want) {
+		t.Errorf("keyOrder.ordered() = %v, want %v", got, want)
+	}
+}
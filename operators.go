@@ -0,0 +1,348 @@
+package jsontemplate
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type unaryOperation struct {
+	operator string
+	operand  template
+}
+
+type binaryOperation struct {
+	operator string
+	left     template
+	right    template
+}
+
+func (o unaryOperation) interpolate(data interface{}, opt options) interface{} {
+	var val = o.operand.interpolate(data, opt)
+	switch o.operator {
+	case "-":
+		return negate(val)
+	case "!":
+		return !truthy(val)
+	default:
+		panic(fmt.Sprintf("jsontemplate: unknown unary operator %s", o.operator))
+	}
+}
+
+func (o binaryOperation) interpolate(data interface{}, opt options) interface{} {
+	if o.operator == "??" {
+		return o.coalesce(data, opt)
+	}
+	var left = o.left.interpolate(data, opt)
+	switch o.operator {
+	case "&&":
+		return truthy(left) && truthy(o.right.interpolate(data, opt))
+	case "||":
+		return truthy(left) || truthy(o.right.interpolate(data, opt))
+	}
+	var right = o.right.interpolate(data, opt)
+	switch o.operator {
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return !equal(left, right)
+	case "<", "<=", ">", ">=":
+		return compare(o.operator, left, right)
+	default:
+		return arithmetic(o.operator, left, right)
+	}
+}
+
+// coalesce evaluates to the left operand unless it is null, in which case the
+// right operand is evaluated instead. Missing keys in a query on the left are
+// treated as null regardless of the missing key policy.
+func (o binaryOperation) coalesce(data interface{}, opt options) interface{} {
+	var left interface{}
+	if q, ok := o.left.(query); ok {
+		var lenient = opt
+		lenient.MissingKeys = NullOnMissing
+		left = q.interpolate(data, lenient)
+	} else {
+		left = o.left.interpolate(data, opt)
+	}
+	if left != nil {
+		return left
+	}
+	return o.right.interpolate(data, opt)
+}
+
+// toFloat converts a numeric value to a float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		var f, err = v.Float64()
+		return f, err == nil
+	}
+	// Input data that isn't decoded from JSON can hold any numeric type.
+	var rv = reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// toInt converts an integral value to an int64. Floating point values are only
+// considered integral if they are exactly representable as such.
+func toInt(v interface{}) (int64, bool) {
+	if n, ok := v.(json.Number); ok {
+		var i, err = n.Int64()
+		return i, err == nil
+	}
+	var rv = reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		var f = rv.Float()
+		return int64(f), f == math.Trunc(f) && math.Abs(f) <= 1<<53
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(rv.Uint()), rv.Uint() <= math.MaxInt64
+	default:
+		return 0, false
+	}
+}
+
+func isJSONNumber(v interface{}) bool {
+	var _, ok = v.(json.Number)
+	return ok
+}
+
+func negate(v interface{}) interface{} {
+	var f, ok = toFloat(v)
+	if !ok {
+		panic(fmt.Errorf("jsontemplate: cannot negate %v (%T)", v, v))
+	}
+	if !isJSONNumber(v) {
+		return -f
+	}
+	if i, ok := toInt(v); ok && i != math.MinInt64 {
+		return json.Number(strconv.FormatInt(-i, 10))
+	}
+	return json.Number(strconv.FormatFloat(-f, 'g', -1, 64))
+}
+
+// equal reports whether two values are equal in the JSON sense. That is,
+// numbers of any type are equal if their values are, and arrays and objects are
+// equal if all their elements or members are.
+func equal(a, b interface{}) bool {
+	if af, ok := toFloat(a); ok {
+		var bf, ok = toFloat(b)
+		if !ok {
+			return false
+		}
+		if ai, ok := toInt(a); ok {
+			if bi, ok := toInt(b); ok {
+				return ai == bi
+			}
+		}
+		return af == bf
+	}
+	var av, bv = reflect.ValueOf(a), reflect.ValueOf(b)
+	switch av.Kind() {
+	case reflect.Slice, reflect.Array:
+		if kind := bv.Kind(); kind != reflect.Slice && kind != reflect.Array {
+			return false
+		} else if av.Len() != bv.Len() {
+			return false
+		}
+		for i := 0; i < av.Len(); i++ {
+			if !equal(av.Index(i).Interface(), bv.Index(i).Interface()) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		var akeys, avalues = members(av)
+		var bkeys, bvalues = members(bv)
+		if akeys == nil || bkeys == nil {
+			break // Not a JSON object.
+		} else if len(akeys) != len(bkeys) {
+			return false
+		}
+		for i := range akeys {
+			if akeys[i] != bkeys[i] || !equal(avalues[i].Interface(), bvalues[i].Interface()) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// hashKey encodes a value such that values that are equal, as determined by
+// equal, have the same encoding. Values that are not equal may share an
+// encoding too, so it can only be used to narrow down candidates for equality.
+func hashKey(res *strings.Builder, v interface{}) {
+	if f, ok := toFloat(v); ok {
+		if f == 0 {
+			f = 0 // Negative zero is equal to zero.
+		}
+		res.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+		return
+	}
+	var rv = reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		res.WriteByte('[')
+		for i := 0; i < rv.Len(); i++ {
+			hashKey(res, rv.Index(i).Interface())
+			res.WriteByte(',')
+		}
+		res.WriteByte(']')
+		return
+	case reflect.Map:
+		var keys, values = members(rv)
+		if keys == nil {
+			break // Not a JSON object.
+		}
+		res.WriteByte('{')
+		for i, key := range keys {
+			res.WriteString(strconv.Quote(key.(string)))
+			res.WriteByte(':')
+			hashKey(res, values[i].Interface())
+			res.WriteByte(',')
+		}
+		res.WriteByte('}')
+		return
+	}
+	if s, ok := v.(string); ok {
+		res.WriteString(strconv.Quote(s))
+	} else {
+		// Other values are compared with reflect.DeepEqual, which requires
+		// them to be of the same type.
+		fmt.Fprintf(res, "%T", v)
+	}
+}
+
+// compare applies an ordering operator to two numbers or two strings.
+func compare(op string, left, right interface{}) bool {
+	var cmp, ok = order(left, right)
+	if !ok {
+		panic(fmt.Errorf("jsontemplate: cannot apply %s to %v (%T) and %v (%T)", op, left, left, right, right))
+	}
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	default:
+		panic(fmt.Sprintf("jsontemplate: unknown comparison operator %s", op))
+	}
+}
+
+// order returns -1, 0 or 1 if the left value is ordered before, the same as or
+// after the right one. Only two numbers or two strings can be ordered.
+func order(left, right interface{}) (cmp int, ok bool) {
+	var l, lok = toFloat(left)
+	var r, rok = toFloat(right)
+	var ls, lsok = left.(string)
+	var rs, rsok = right.(string)
+	switch {
+	case lok && rok:
+		var li, liok = toInt(left)
+		var ri, riok = toInt(right)
+		if liok && riok {
+			// Compare integers exactly to avoid losing precision.
+			if li < ri {
+				return -1, true
+			} else if li > ri {
+				return 1, true
+			}
+		} else if l < r {
+			return -1, true
+		} else if l > r {
+			return 1, true
+		}
+		return 0, true
+	case lsok && rsok:
+		return strings.Compare(ls, rs), true
+	default:
+		return 0, false
+	}
+}
+
+// arithmetic applies an arithmetic operator to two numbers.
+func arithmetic(op string, left, right interface{}) interface{} {
+	var l, lok = toFloat(left)
+	var r, rok = toFloat(right)
+	if !lok || !rok {
+		panic(fmt.Errorf("jsontemplate: cannot apply %s to %v (%T) and %v (%T)", op, left, left, right, right))
+	}
+	if (op == "/" || op == "%") && r == 0 {
+		panic(fmt.Errorf("jsontemplate: division by zero: %v %s %v", left, op, right))
+	}
+	if !isJSONNumber(left) && !isJSONNumber(right) {
+		return floatArithmetic(op, l, r)
+	}
+	// Keep the precision of integers when possible.
+	var li, liok = toInt(left)
+	var ri, riok = toInt(right)
+	if liok && riok {
+		if res, ok := intArithmetic(op, li, ri); ok {
+			return json.Number(strconv.FormatInt(res, 10))
+		}
+	}
+	return json.Number(strconv.FormatFloat(floatArithmetic(op, l, r), 'g', -1, 64))
+}
+
+func floatArithmetic(op string, l, r float64) float64 {
+	switch op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	case "/":
+		return l / r
+	case "%":
+		return math.Mod(l, r)
+	default:
+		panic(fmt.Sprintf("jsontemplate: unknown arithmetic operator %s", op))
+	}
+}
+
+// intArithmetic applies an arithmetic operator to two integers. It returns
+// false if the result is not an integer or does not fit in an int64.
+func intArithmetic(op string, l, r int64) (int64, bool) {
+	switch op {
+	case "+":
+		var res = l + r
+		return res, (res > l) == (r > 0)
+	case "-":
+		var res = l - r
+		return res, (res < l) == (r > 0)
+	case "*":
+		if l == 0 || r == 0 {
+			return 0, true
+		}
+		var res = l * r
+		return res, res/r == l && !(l == -1 && r == math.MinInt64) && !(r == -1 && l == math.MinInt64)
+	case "/":
+		return l / r, l%r == 0 && !(l == math.MinInt64 && r == -1)
+	case "%":
+		return l % r, true
+	default:
+		panic(fmt.Sprintf("jsontemplate: unknown arithmetic operator %s", op))
+	}
+}
@@ -0,0 +1,275 @@
+package jsontemplate
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_unaryOperation_interpolate(t *testing.T) {
+	tests := []struct {
+		name      string
+		o         unaryOperation
+		want      interface{}
+		wantPanic bool
+	}{
+		{
+			name: "negate float",
+			o:    unaryOperation{operator: "-", operand: numberConstant(1.5)},
+			want: float64(-1.5),
+		},
+		{
+			name: "negate integer",
+			o:    unaryOperation{operator: "-", operand: query{expression: mustParseJSONPath("$")}},
+			want: float64(-123),
+		},
+		{
+			name:      "negate string",
+			o:         unaryOperation{operator: "-", operand: stringConstant("foo")},
+			wantPanic: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantPanic {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Errorf("unaryOperation.interpolate() did not panic as expected")
+					}
+				}()
+			}
+			if got := tt.o.interpolate(123, options{}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unaryOperation.interpolate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_binaryOperation_interpolate(t *testing.T) {
+	// The right operand panics if evaluated, to test short-circuiting.
+	var fail = unaryOperation{operator: "-", operand: stringConstant("foo")}
+	tests := []struct {
+		name string
+		o    binaryOperation
+		want interface{}
+	}{
+		{
+			name: "and short-circuit",
+			o:    binaryOperation{operator: "&&", left: nullConstant{}, right: fail},
+			want: false,
+		},
+		{
+			name: "and",
+			o:    binaryOperation{operator: "&&", left: numberConstant(0), right: stringConstant("")},
+			want: true,
+		},
+		{
+			name: "or short-circuit",
+			o:    binaryOperation{operator: "||", left: boolConstant(true), right: fail},
+			want: true,
+		},
+		{
+			name: "or",
+			o:    binaryOperation{operator: "||", left: boolConstant(false), right: nullConstant{}},
+			want: false,
+		},
+		{
+			name: "coalesce short-circuit",
+			o:    binaryOperation{operator: "??", left: boolConstant(false), right: fail},
+			want: false,
+		},
+		{
+			name: "coalesce",
+			o:    binaryOperation{operator: "??", left: nullConstant{}, right: numberConstant(1)},
+			want: float64(1),
+		},
+		{
+			name: "not equal",
+			o:    binaryOperation{operator: "!=", left: numberConstant(1), right: stringConstant("1")},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.o.interpolate(nil, options{}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("binaryOperation.interpolate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_equal(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b interface{}
+		want bool
+	}{
+		{name: "numbers", a: 1, b: float64(1), want: true},
+		{name: "exact integers", a: json.Number("9007199254740993"), b: json.Number("9007199254740992"), want: false},
+		{name: "number and string", a: 1, b: "1", want: false},
+		{name: "nulls", a: nil, b: nil, want: true},
+		{name: "arrays", a: []interface{}{1, "a"}, b: []int{1}, want: false},
+		{name: "nested arrays", a: []interface{}{[]int{1}}, b: []interface{}{[]float64{1}}, want: true},
+		{
+			name: "objects",
+			a:    map[string]interface{}{"a": 1, "b": []interface{}{true}},
+			b:    map[string]interface{}{"b": []bool{true}, "a": json.Number("1")},
+			want: true,
+		},
+		{
+			name: "different objects",
+			a:    map[string]interface{}{"a": 1},
+			b:    map[string]interface{}{"b": 1},
+			want: false,
+		},
+		{name: "zeros", a: math.Copysign(0, -1), b: json.Number("0"), want: true},
+		{name: "strings", a: "a", b: "a", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := equal(tt.a, tt.b); got != tt.want {
+				t.Errorf("equal() = %v, want %v", got, tt.want)
+			}
+			// Equal values must have equal hash keys.
+			var a, b strings.Builder
+			hashKey(&a, tt.a)
+			hashKey(&b, tt.b)
+			if tt.want && a.String() != b.String() {
+				t.Errorf("hashKey() = %s and %s for equal values", a.String(), b.String())
+			}
+		})
+	}
+}
+
+func Test_compare(t *testing.T) {
+	tests := []struct {
+		name        string
+		op          string
+		left, right interface{}
+		want        bool
+		wantPanic   bool
+	}{
+		{name: "less", op: "<", left: 1, right: 1.5, want: true},
+		{name: "less or equal", op: "<=", left: 2, right: json.Number("2"), want: true},
+		{name: "greater", op: ">", left: json.Number("9007199254740993"), right: json.Number("9007199254740992"), want: true},
+		{name: "greater or equal", op: ">=", left: "a", right: "b", want: false},
+		{name: "mixed", op: "<", left: 1, right: "2", wantPanic: true},
+		{name: "booleans", op: "<", left: false, right: true, wantPanic: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantPanic {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Errorf("compare() did not panic as expected")
+					}
+				}()
+			}
+			if got := compare(tt.op, tt.left, tt.right); got != tt.want {
+				t.Errorf("compare() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_arithmetic(t *testing.T) {
+	tests := []struct {
+		name      string
+		op        string
+		left      interface{}
+		right     interface{}
+		want      interface{}
+		wantPanic bool
+	}{
+		{name: "add", op: "+", left: 1.5, right: 2.0, want: 3.5},
+		{name: "subtract", op: "-", left: 1.5, right: 2.0, want: -0.5},
+		{name: "multiply", op: "*", left: 1.5, right: 2.0, want: 3.0},
+		{name: "divide", op: "/", left: 1.5, right: 2.0, want: 0.75},
+		{name: "remainder", op: "%", left: 7.0, right: 2.0, want: 1.0},
+		{name: "go integers", op: "*", left: 3, right: uint8(2), want: 6.0},
+		{name: "division by zero", op: "/", left: 1.0, right: 0.0, wantPanic: true},
+		{name: "remainder by zero", op: "%", left: 1.0, right: 0, wantPanic: true},
+		{name: "string", op: "+", left: "1", right: 2.0, wantPanic: true},
+		{name: "null", op: "+", left: 1.0, right: nil, wantPanic: true},
+		{
+			name:  "exact integers",
+			op:    "+",
+			left:  json.Number("9007199254740993"),
+			right: json.Number("2"),
+			want:  json.Number("9007199254740995"),
+		},
+		{
+			name:  "exact division",
+			op:    "/",
+			left:  json.Number("9007199254740994"),
+			right: 2,
+			want:  json.Number("4503599627370497"),
+		},
+		{
+			name:  "inexact division",
+			op:    "/",
+			left:  json.Number("3"),
+			right: json.Number("2"),
+			want:  json.Number("1.5"),
+		},
+		{
+			name:  "overflow",
+			op:    "*",
+			left:  json.Number("9223372036854775807"),
+			right: json.Number("2"),
+			want:  json.Number("1.8446744073709552e+19"),
+		},
+		{
+			name:  "json.Number and float",
+			op:    "-",
+			left:  json.Number("1.5"),
+			right: 1.0,
+			want:  json.Number("0.5"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantPanic {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Errorf("arithmetic() did not panic as expected")
+					}
+				}()
+			}
+			if got := arithmetic(tt.op, tt.left, tt.right); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("arithmetic() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_intArithmetic(t *testing.T) {
+	tests := []struct {
+		name   string
+		op     string
+		l, r   int64
+		want   int64
+		wantOK bool
+	}{
+		{name: "add", op: "+", l: 1, r: 2, want: 3, wantOK: true},
+		{name: "add overflow", op: "+", l: math.MaxInt64, r: 1, wantOK: false},
+		{name: "add underflow", op: "+", l: math.MinInt64, r: -1, wantOK: false},
+		{name: "subtract", op: "-", l: 1, r: 2, want: -1, wantOK: true},
+		{name: "subtract overflow", op: "-", l: math.MinInt64, r: 1, wantOK: false},
+		{name: "multiply", op: "*", l: -3, r: 2, want: -6, wantOK: true},
+		{name: "multiply overflow", op: "*", l: math.MinInt64, r: -1, wantOK: false},
+		{name: "divide", op: "/", l: 6, r: 3, want: 2, wantOK: true},
+		{name: "divide inexact", op: "/", l: 7, r: 3, wantOK: false},
+		{name: "remainder", op: "%", l: -7, r: 3, want: -1, wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := intArithmetic(tt.op, tt.l, tt.r)
+			if ok != tt.wantOK || (ok && got != tt.want) {
+				t.Errorf("intArithmetic() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
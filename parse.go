@@ -1,9 +1,13 @@
 package jsontemplate
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
+	"path"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/Volumental/jsontemplate/internal/parse"
@@ -11,82 +15,621 @@ import (
 )
 
 type builder struct {
-	funcs FunctionMap
+	funcs  FunctionMap
+	vars   []string // Variables in scope, innermost last.
+	loader Loader
+	files  []string // Files being included, outermost first.
+	defs   map[string]*definition
+	params []string // Parameters declared by the template.
+}
+
+// variableName returns the name of the variable referenced by a query, or the
+// empty string if the query is evaluated against the current `$`.
+func variableName(q string) string {
+	var end = 1
+	for end < len(q) && (q[end] == '_' || isAlphaNumeric(q[end])) {
+		end++
+	}
+	return q[1:end]
+}
+
+func isAlphaNumeric(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// globalVariables are the variables in scope everywhere in a template.
+var globalVariables = []string{rootVariable, paramsVariable}
+
+// declare adds a variable to the scope of the builder. The returned function
+// removes it again.
+func (b *builder) declare(v string) (name string, undeclare func()) {
+	if name = variableName(v); len(name)+1 != len(v) {
+		panic(fmt.Errorf("jsontemplate: invalid variable name: %s", v))
+	} else if name == rootVariable || name == paramsVariable {
+		panic(fmt.Errorf("jsontemplate: cannot redeclare %s", v))
+	}
+	var prev = b.vars
+	b.vars = append(b.vars[:len(b.vars):len(b.vars)], name)
+	return name, func() { b.vars = prev }
+}
+
+func (b *builder) declared(name string) bool {
+	for _, v := range b.vars {
+		if v == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (b *builder) buildObject(o *parse.Object) object {
-	var res = object{}
-	for _, f := range o.Fields {
-		res[f.Key] = field{
-			value:      b.buildValue(&f.Value),
+	var res = make(object, len(o.Fields))
+	for i, f := range o.Fields {
+		res[i] = field{
+			key:        f.Key,
+			value:      b.buildExpression(&f.Value),
 			annotation: f.Annotation,
 		}
+		if f.Spread {
+			res[i].value = spread{res[i].value}
+		} else if f.ComputedKey != nil {
+			res[i].computedKey = b.buildExpression(f.ComputedKey)
+		}
 	}
 	return res
 }
 
 func (b *builder) buildQuery(q *string) query {
+	var res query
+	var path = *q
+	if res.variable = variableName(path); res.variable != "" {
+		if !b.declared(res.variable) {
+			panic(fmt.Errorf("jsontemplate: undefined variable: $%s", res.variable))
+		}
+		if path = path[len(res.variable)+1:]; path == "" {
+			// A plain variable reference, no need to query it.
+			return res
+		}
+		if res.variable == paramsVariable && !b.declaredParam(firstKey(path)) {
+			panic(fmt.Errorf("jsontemplate: undefined parameter: %s", *q))
+		}
+		path = "$" + path
+	}
 	var jp = jsonpath.New("template-query")
-	if err := jp.Parse(fmt.Sprintf("{%s}", *q)); err != nil {
+	if err := jp.Parse(fmt.Sprintf("{%s}", normalizePath(path))); err != nil {
 		panic(fmt.Errorf("jsontemplate: invalid jsonpath: %v", err))
 	}
-	return query{expression: jp}
+	res.expression = jp
+	return res
+}
+
+// singular reports whether a query yields at most one value, which is the case
+// unless it contains wildcards, slices, unions, filters or recursive descent.
+func singular(q string) bool {
+	var path = "$" + q[len(variableName(q))+1:]
+	var p, err = jsonpath.Parse("template-query", fmt.Sprintf("{%s}", normalizePath(path)))
+	if err != nil {
+		return false // Reported when the query is built.
+	}
+	var nodes = p.Root.Nodes
+	for len(nodes) > 0 {
+		var node = nodes[0]
+		nodes = nodes[1:]
+		switch node := node.(type) {
+		case *jsonpath.ListNode:
+			nodes = append(nodes, node.Nodes...)
+		case *jsonpath.ArrayNode:
+			if !node.Params[1].Derived {
+				return false // A slice rather than an index.
+			}
+		case *jsonpath.FieldNode, *jsonpath.IdentifierNode, *jsonpath.TextNode:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// normalizePath rewrites quoted keys in brackets, such as `$["content-type"]`
+// or `$['first name']`, to the dotted form understood by the query engine, with
+// any characters special to it escaped. Other brackets are left as they are.
+func normalizePath(path string) string {
+	var res strings.Builder
+	for i := 0; i < len(path); {
+		switch path[i] {
+		case '\\':
+			// An escaped character in a dotted key.
+			if i+1 < len(path) && path[i+1] == '\\' {
+				panic(errBackslashKey)
+			}
+			res.WriteByte(path[i])
+			if i++; i < len(path) {
+				res.WriteByte(path[i])
+				i++
+			}
+		case '[':
+			var end = bracketEnd(path, i)
+			if key, ok := quotedKey(path[i+1 : end-1]); ok {
+				res.WriteByte('.')
+				res.WriteString(escapeKey(key))
+			} else {
+				res.WriteString(path[i:end])
+			}
+			i = end
+		default:
+			res.WriteByte(path[i])
+			i++
+		}
+	}
+	return res.String()
+}
+
+// firstKey returns the key selected by the first segment of a path, such as
+// "a" for `.a.b` or `['a'][0]`, or the empty string if it doesn't select a
+// single key.
+func firstKey(path string) string {
+	switch {
+	case strings.HasPrefix(path, ".") && !strings.HasPrefix(path, ".."):
+		var end = strings.IndexAny(path[1:], ".[")
+		if end < 0 {
+			return path[1:]
+		}
+		return path[1 : end+1]
+	case strings.HasPrefix(path, "["):
+		var key, _ = quotedKey(path[1 : bracketEnd(path, 0)-1])
+		return key
+	}
+	return ""
+}
+
+// bracketEnd returns the index just after the bracket closing the one at start,
+// skipping over nested brackets and quoted strings.
+func bracketEnd(path string, start int) int {
+	var depth = 0
+	for i := start; i < len(path); i++ {
+		switch c := path[i]; c {
+		case '"', '\'':
+			for i++; i < len(path) && path[i] != c; i++ {
+				if path[i] == '\\' {
+					i++
+				}
+			}
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(path)
+}
+
+// quotedKey returns the unquoted key if s is a single quoted string.
+func quotedKey(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || (s[0] != '"' && s[0] != '\'') || s[len(s)-1] != s[0] {
+		return "", false
+	}
+	var key strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case s[0]:
+			return "", false // Several strings, as in `['a','b']`.
+		}
+		key.WriteByte(s[i])
+	}
+	return key.String(), true
+}
+
+// errBackslashKey is returned for keys containing backslashes, which the query
+// engine removes from keys however they are escaped.
+var errBackslashKey = fmt.Errorf("jsontemplate: invalid jsonpath: keys containing backslashes are not supported")
+
+func escapeKey(key string) string {
+	if strings.ContainsRune(key, '\\') {
+		panic(errBackslashKey)
+	}
+	var res strings.Builder
+	for _, c := range key {
+		if strings.ContainsRune(" \t\r\n.,[]$@{}*", c) {
+			res.WriteByte('\\')
+		}
+		res.WriteRune(c)
+	}
+	return res.String()
+}
+
+func (b *builder) buildGenerator(node *parse.Generator) template {
+	var res = generator{over: b.buildQuery(&node.Range)}
+	if node.Group && node.By == nil {
+		panic(fmt.Errorf("jsontemplate: group requires a by clause"))
+	} else if !node.Group && node.By != nil {
+		panic(fmt.Errorf("jsontemplate: by clause can only be used with group"))
+	} else if node.Group {
+		// The key is evaluated for each element, before they are grouped.
+		res.groupBy = b.buildExpression(node.By)
+	}
+	// Pagination is evaluated outside of the scope of the elements.
+	if node.Limit != nil {
+		res.limit = b.buildExpression(node.Limit)
+	}
+	if node.Offset != nil {
+		res.offset = b.buildExpression(node.Offset)
+	}
+	if node.Key != "" {
+		var undeclare func()
+		res.key, undeclare = b.declare(node.Key)
+		defer undeclare()
+		// Whether to range over the members of an object is decided by the
+		// query rather than by its result, as an array with a single object in
+		// it would otherwise be mistaken for the object.
+		res.members = singular(node.Range)
+	}
+	if node.Variable != "" {
+		var undeclare func()
+		res.variable, undeclare = b.declare(node.Variable)
+		defer undeclare()
+	}
+	if node.Where != nil {
+		res.where = b.buildExpression(node.Where)
+	}
+	for _, o := range node.OrderBy {
+		res.orderBy = append(res.orderBy, ordering{
+			key:        b.buildExpression(&o.Key),
+			descending: o.Descending,
+		})
+	}
+	if node.Members != nil {
+		res.memberKey = b.buildExpression(&node.Members.Key)
+		res.template = b.buildExpression(&node.Members.Value)
+	} else {
+		res.template = b.buildExpression(&node.SubTemplate)
+	}
+	return res
+}
+
+func (b *builder) buildMatch(node *parse.Match) template {
+	var res = match{value: b.buildExpression(&node.Value)}
+	for i, arm := range node.Arms {
+		if !arm.Default {
+			res.patterns = append(res.patterns, b.buildExpression(arm.Pattern))
+			res.arms = append(res.arms, b.buildExpression(&arm.Value))
+		} else if i != len(node.Arms)-1 {
+			panic(fmt.Errorf("jsontemplate: the default arm of a match must be the last one"))
+		} else {
+			res.otherwise = b.buildExpression(&arm.Value)
+		}
+	}
+	return res
+}
+
+func (b *builder) buildLet(node *parse.Let) template {
+	var res = let{
+		names:  make([]string, len(node.Bindings)),
+		values: make([]template, len(node.Bindings)),
+	}
+	for i, binding := range node.Bindings {
+		// Each binding is in scope of the ones following it.
+		res.values[i] = b.buildExpression(&binding.Value)
+		var undeclare func()
+		res.names[i], undeclare = b.declare(binding.Name)
+		defer undeclare()
+	}
+	res.body = b.buildExpression(&node.Body)
+	return res
+}
+
+func (b *builder) buildTemplate(t *parse.Template) template {
+	b.buildDefinitions(t.Definitions)
+	return b.buildExpression(&t.Root)
+}
+
+// buildInclude parses and builds an included template. Its path is resolved
+// relative to the directory of the including file. The included template has a
+// scope of its own, so only `$`, `$root` and `$params` are available within it.
+func (b *builder) buildInclude(node *parse.Include) template {
+	if b.loader == nil {
+		panic(fmt.Errorf("jsontemplate: %s: cannot include %q: no loader", node.Pos, node.Path))
+	}
+	var name = path.Join(path.Dir(node.Pos.Filename), node.Path)
+	for _, f := range b.files {
+		if f == name {
+			var cycle = strings.Join(append(b.files[:len(b.files):len(b.files)], name), " -> ")
+			panic(fmt.Errorf("jsontemplate: %s: include cycle: %s", node.Pos, cycle))
+		}
+	}
+	var r, err = b.loader.Load(name)
+	if err != nil {
+		panic(fmt.Errorf("jsontemplate: %s: cannot include %q: %v", node.Pos, node.Path, err))
+	}
+	defer r.Close()
+	var ast parse.Template
+	if err := parse.Parser.Parse(namedReader{r, name}, &ast); err != nil {
+		panic(fmt.Errorf("jsontemplate: %s: parse error in included file: %v", node.Pos, err))
+	} else if len(ast.Params) > 0 {
+		panic(fmt.Errorf("jsontemplate: %s: parameters cannot be declared in included file %s", node.Pos, name))
+	}
+	var inner = builder{
+		funcs:  b.funcs,
+		vars:   globalVariables,
+		loader: b.loader,
+		files:  append(b.files[:len(b.files):len(b.files)], name),
+		params: b.params,
+	}
+	return inner.buildTemplate(&ast)
 }
 
 func (b *builder) buildFunction(node *parse.Function) template {
+	return b.buildCall(node.Name, nil, node.Args)
+}
+
+// buildCall builds a call to the named function, with the given arguments
+// preceding the ones parsed from the template.
+func (b *builder) buildCall(name string, args []template, exprs []parse.Expression) template {
+	if def, ok := b.defs[name]; ok {
+		for _, e := range exprs {
+			args = append(args, b.buildExpression(&e))
+		}
+		if len(args) != len(def.params) {
+			panic(fmt.Errorf("jsontemplate: %s takes %d arguments, got %d", name, len(def.params), len(args)))
+		}
+		return call{definition: def, args: args}
+	}
+	for _, e := range exprs {
+		if l := lambdaExpression(&e); l != nil {
+			args = append(args, b.buildLambda(l))
+		} else {
+			args = append(args, b.buildExpression(&e))
+		}
+	}
 	var res = function{
-		name: node.Name,
-		args: make([]template, len(node.Args)),
+		name: name,
+		args: args,
 	}
 	var ok bool
-	if res.function, ok = b.funcs[node.Name]; !ok {
-		panic(fmt.Errorf("jsontemplate: no such function: %s", node.Name))
+	if res.function, ok = b.funcs[name]; !ok {
+		panic(fmt.Errorf("jsontemplate: no such function: %s", name))
 	} else if fun := reflect.ValueOf(res.function); fun.Kind() != reflect.Func {
-		panic(fmt.Sprintf("%s is not a function", node.Name)) // Actual panic.
+		panic(fmt.Sprintf("%s is not a function", name)) // Actual panic.
 	}
 	// TODO(josef): Verify that the signature has a single return value.
-	for i, v := range node.Args {
-		res.args[i] = b.buildValue(&v)
+	return res
+}
+
+// lambdaExpression returns the lambda an expression consists of, if any.
+func lambdaExpression(e *parse.Expression) *parse.Lambda {
+	if len(e.Operand.Unary) > 0 || len(e.Operations) > 0 || len(e.Pipeline) > 0 {
+		return nil
 	}
+	return e.Operand.Value.Lambda
+}
+
+func (b *builder) buildLambda(node *parse.Lambda) template {
+	var res = lambda{params: make([]string, len(node.Params.Names))}
+	for i, param := range node.Params.Names {
+		var undeclare func()
+		res.params[i], undeclare = b.declare(param)
+		defer undeclare()
+	}
+	res.body = b.buildExpression(&node.Body)
 	return res
 }
 
+// buildDefinitions builds the definitions of a template. All of them are
+// declared before any is built, so they may call each other recursively.
+func (b *builder) buildDefinitions(nodes []parse.Definition) {
+	b.defs = make(map[string]*definition, len(nodes))
+	var res = make([]*definition, len(nodes))
+	for i, node := range nodes {
+		if _, ok := b.defs[node.Name]; ok {
+			panic(fmt.Errorf("jsontemplate: %s is defined more than once", node.Name))
+		}
+		res[i] = &definition{name: node.Name}
+		b.defs[node.Name] = res[i]
+	}
+	for i, node := range nodes {
+		// Only the parameters and the global variables are in scope of the body.
+		var outer = b.vars
+		b.vars = globalVariables
+		for _, param := range node.Params {
+			var name, _ = b.declare(param)
+			res[i].params = append(res[i].params, name)
+		}
+		res[i].body = b.buildExpression(&node.Body)
+		b.vars = outer
+	}
+}
+
 func (b *builder) buildValue(v *parse.Value) template {
 	switch {
 	case v.String != nil:
 		return stringConstant(*v.String)
 	case v.Number != nil:
-		return numberConstant(*v.Number)
+		return buildNumber(string(*v.Number))
 	case v.Bool != nil:
 		return boolConstant(*v.Bool)
 	case v.Null:
 		return nullConstant{}
 	case v.Object != nil:
 		return b.buildObject(v.Object)
+	case v.Empty:
+		return array{}
 	case v.Array != nil:
 		var res = make(array, len(v.Array))
-		for i, v := range v.Array {
-			res[i] = b.buildValue(&v)
+		for i, e := range v.Array {
+			res[i] = b.buildExpression(&e.Value)
+			if e.Spread {
+				res[i] = spread{res[i]}
+			}
 		}
 		return res
 	case v.Generator != nil:
-		return generator{
-			over:     b.buildQuery(&v.Generator.Range),
-			template: b.buildValue(&v.Generator.SubTemplate),
+		return b.buildGenerator(v.Generator)
+	case v.Match != nil:
+		return b.buildMatch(v.Match)
+	case v.Conditional != nil:
+		return conditional{
+			condition: b.buildExpression(&v.Conditional.Condition),
+			then:      b.buildExpression(&v.Conditional.Then),
+			otherwise: b.buildExpression(&v.Conditional.Else),
+		}
+	case v.Let != nil:
+		return b.buildLet(v.Let)
+	case v.Lambda != nil:
+		panic(fmt.Errorf("jsontemplate: lambdas can only be passed as arguments to functions"))
+	case v.Include != nil:
+		return b.buildInclude(v.Include)
+	case v.Interpolation != nil:
+		var res = templateString{
+			parts:  v.Interpolation.Parts,
+			values: make([]template, len(v.Interpolation.Values)),
 		}
+		for i, e := range v.Interpolation.Values {
+			res.values[i] = b.buildExpression(&e)
+		}
+		return res
 	case v.Extractor != nil:
 		return b.buildQuery(v.Extractor)
 	case v.Function != nil:
 		return b.buildFunction(v.Function)
+	case v.Expression != nil:
+		return b.buildExpression(v.Expression)
 	default:
 		panic("unhandled case")
 	}
 }
 
+// buildNumber builds a number literal. Integers that can't be represented
+// exactly as a float64 are kept as written.
+func buildNumber(s string) template {
+	var f, err = strconv.ParseFloat(s, 64)
+	if err != nil {
+		panic(fmt.Errorf("jsontemplate: invalid number %s: %v", s, err))
+	}
+	if !strings.ContainsAny(s, ".eE") && strconv.FormatFloat(f, 'f', -1, 64) != s {
+		return integerConstant(json.Number(s))
+	}
+	return numberConstant(f)
+}
+
+func (b *builder) buildOperand(o *parse.Operand) template {
+	var res = b.buildValue(&o.Value)
+	for i := len(o.Unary) - 1; i >= 0; i-- {
+		// Negative number literals are kept as constants.
+		if n, ok := res.(numberConstant); ok && o.Unary[i] == "-" {
+			res = -n
+			continue
+		} else if n, ok := res.(integerConstant); ok && o.Unary[i] == "-" {
+			if strings.HasPrefix(string(n), "-") {
+				res = n[1:]
+			} else {
+				res = "-" + n
+			}
+			continue
+		}
+		res = unaryOperation{operator: o.Unary[i], operand: res}
+	}
+	return res
+}
+
+func (b *builder) buildExpression(e *parse.Expression) template {
+	var operands = make([]template, len(e.Operations)+1)
+	var operators = make([]string, len(e.Operations))
+	operands[0] = b.buildOperand(&e.Operand)
+	for i, op := range e.Operations {
+		operators[i] = op.Operator
+		operands[i+1] = b.buildOperand(&op.Operand)
+	}
+	var res = combine(operands, operators)
+	for _, stage := range e.Pipeline {
+		res = b.buildCall(stage.Name, []template{res}, stage.Args)
+	}
+	return res
+}
+
+// precedence of the binary operators. Operators with higher precedence bind
+// more tightly.
+var precedence = map[string]int{
+	"??": 1,
+	"||": 2,
+	"&&": 3,
+	"==": 4, "!=": 4, "<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+// combine builds a tree of binary operations from a sequence of operands
+// separated by operators, according to the precedence of the operators. All
+// operators are left-associative, except `??` which is right-associative so
+// that each operand can be checked for missing keys in turn.
+func combine(operands []template, operators []string) template {
+	if len(operators) == 0 {
+		return operands[0]
+	}
+	// The root of the tree is the last of the operators binding most loosely,
+	// or the first for right-associative ones.
+	var root = len(operators) - 1
+	for i := root - 1; i >= 0; i-- {
+		var p, q = precedence[operators[i]], precedence[operators[root]]
+		if p < q || p == q && operators[i] == "??" {
+			root = i
+		}
+	}
+	return binaryOperation{
+		operator: operators[root],
+		left:     combine(operands[:root+1], operators[:root]),
+		right:    combine(operands[root+1:], operators[root+1:]),
+	}
+}
+
 // FunctionMap is a map of named functions that may be called from within a
 // template.
 type FunctionMap map[string]interface{}
 
+// Loader loads template definitions referenced by includes.
+type Loader interface {
+	// Load opens the template definition with the given slash-separated path
+	// name.
+	Load(name string) (io.ReadCloser, error)
+}
+
+// FSLoader returns a Loader reading template definitions from a file system.
+func FSLoader(fsys fs.FS) Loader {
+	return fsLoader{fsys}
+}
+
+type fsLoader struct {
+	fsys fs.FS
+}
+
+func (l fsLoader) Load(name string) (io.ReadCloser, error) {
+	return l.fsys.Open(name)
+}
+
+// namedReader lets the parser know the name of the file it reads, so that it
+// can be included in error messages.
+type namedReader struct {
+	io.Reader
+	name string
+}
+
+func (r namedReader) Name() string { return r.name }
+
+// ParseFile works like Parse, but reads the named template definition from a
+// loader. Any includes in the definition are resolved using the same loader.
+func ParseFile(loader Loader, name string, funcs FunctionMap) (*Template, error) {
+	var r, err = loader.Load(name)
+	if err != nil {
+		return nil, fmt.Errorf("jsontemplate: %v", err)
+	}
+	defer r.Close()
+	var b = builder{funcs: funcs, vars: globalVariables, loader: loader, files: []string{name}}
+	return b.parse(namedReader{r, name})
+}
+
 // ParseString works like Parse, but takes a string as input rather than a
 // Reader.
 func ParseString(s string, funcs FunctionMap) (*Template, error) {
@@ -110,6 +653,12 @@ func ParseString(s string, funcs FunctionMap) (*Template, error) {
 //         "single_x": $.foo.x,
 //         "array_of_all_x_recursively": $..x
 //     }
+// Keys may contain hyphens and non-ASCII letters, as in `$.headers.x-request-id`,
+// so a subtraction following a query must be separated from it by spaces. Any
+// other key can be written in brackets as a quoted string, and brackets can also
+// hold indices, slices and filters, including at the root:
+//     [$["content-type"], $['first name'], $[0], $.items[?(@.id == "a]b")].name]
+// Keys containing backslashes are not supported.
 //
 // Generators
 //
@@ -123,6 +672,175 @@ func ParseString(s string, funcs FunctionMap) (*Template, error) {
 // input array. Thus, the example above maps the fields `x` and `y` to `foo` and
 // `bar`, respectively, in the objects in the output array.
 //
+// Generators can also build objects rather than arrays. In that case, the
+// sub-template is enclosed in braces and preceded by a template for the key of
+// each member, separated by a colon:
+//     range $.some_array_of_xy[*] {
+//         $.id: { "foo": $.x, "bar": $.y }
+//     }
+// The key must evaluate to a string. How members generated with the same key are
+// handled is controlled by the DuplicateKeys policy of the template.
+//
+// To group the elements of an array, use `group` rather than `range`, followed
+// by the array expression and a `by` clause. The generator then ranges over
+// arrays of the elements for which the `by` clause evaluates to equal keys, in
+// the order the keys first appear. The key of each group is bound to the first
+// variable of the generator:
+//     group $category, $items in $.items[*] by $.category [
+//         { "category": $category, "items": $items }
+//     ]
+// Any further clauses, as described below, apply to the groups.
+//
+// The elements a generator ranges over can be filtered, sorted and paginated by
+// clauses following the range expression, in this order:
+//     range $.books[*] where $.price < 10 order by $.author, $.title desc limit 10 [
+//         $.title
+//     ]
+// The `where` clause keeps only the elements for which its condition is true,
+// following the same rules of truth as conditionals. The `order by` clause
+// sorts the elements by one or more keys, each optionally followed by `asc` or
+// `desc`. Keys must be numbers or strings, with null ordered first. Elements
+// with equal keys keep their order. Finally, `offset` skips a number of
+// elements and `limit` restricts how many are kept. The conditions and keys are
+// evaluated for each element, with `$` and any variables of the generator
+// referring to it, while the offset and limit are evaluated once, outside of
+// the generator.
+//
+// Computed keys
+//
+// The key of an object member can be taken from the input data by enclosing an
+// expression in brackets in place of the key:
+//     { [$.locale]: $.text }
+// The expression must evaluate to a string. As for generated objects, how
+// members with the same key are handled is controlled by the DuplicateKeys
+// policy of the template. This does not apply to members inserted by spreading.
+//
+// Spreading
+//
+// The members of an object, or the elements of an array, can be inserted into an
+// enclosing object or array, respectively, by prefixing it with `...`:
+//     {
+//         ...$.user,
+//         "name": $.user.first_name,
+//         "tags": [...$.user.tags, "imported"]
+//     }
+// Members are inserted in order, so later members replace earlier ones with the
+// same key. Spreading null inserts nothing, while spreading a value of any other
+// type than the enclosing object or array is an error.
+//
+// Conditionals
+//
+// A template can choose between two values depending on the input data, using
+// the keywords `if`, `then` and `else`:
+//     { "name": if $.nickname then $.nickname else $.full_name }
+// The condition is considered false if it evaluates to null or false, and true
+// otherwise. Only the chosen branch is evaluated, so queries in the other branch
+// will not cause errors even when MissingKeys is set to ErrorOnMissing.
+//
+// To choose between more than two values, depending on the value of a single
+// expression, use `match`. The arm whose pattern is equal to the value is
+// chosen, following the same rules of equality as the `==` operator. If none is,
+// the arm with the pattern `_` is chosen:
+//     match $.type {
+//         "created": { "id": $.id, "state": "new" },
+//         "deleted": { "id": $.id, "state": null },
+//         _: $.previous_state,
+//     }
+// Patterns are evaluated in order until one matches, and only the chosen arm is
+// evaluated. If no pattern matches and there is no `_` arm, rendering fails.
+//
+// Variables
+//
+// Values can be bound to named variables using the `let` keyword. This is
+// useful to avoid repeating long queries. The variables are in scope of the
+// value following the `in` keyword, and of the bindings following them, where
+// they can be used in place of `$` in queries:
+//     let $book = $.store.book[0], $author = $book.author in {
+//         "title": $book.title,
+//         "name": $author.name,
+//         "address": $author.address
+//     }
+// Each variable is evaluated at most once, the first time it is referenced.
+//
+// Generators can also bind each element to a variable, using the keyword `in`.
+// This makes it possible to refer to enclosing elements from within nested
+// generators. Likewise, the root of the input data is always available as
+// `$root`:
+//     range $order in $.orders[*] [
+//         range $line in $order.lines[*] [
+//             { "order": $order.id, "sku": $line.sku, "shop": $root.shop }
+//         ]
+//     ]
+// If two variables are given, the first one is bound to the index of each
+// element, starting from zero. As a special case, if the range expression
+// selects a single object, without any wildcards, slices, unions, filters or
+// recursive descent, the generator iterates over its members in key order,
+// binding the first variable to the key of each member:
+//     range $key, $value in $.headers [
+//         { "name": $key, "value": $value }
+//     ]
+//
+// Parameters
+//
+// Values that are not part of the input data, such as a tenant or a locale, can
+// be passed to RenderWithParams as parameters of the template. Each parameter
+// is declared before any definitions with the keyword `param`, optionally
+// followed by a default value, and is available as a member of `$params`:
+//     param tenant
+//     param locale = "en"
+//     { "tenant": $params.tenant, "locale": $params.locale, "title": $.title }
+// Rendering fails if a parameter without a default value is not supplied, or if
+// one that is not declared is. Default values are evaluated against the input
+// data, and can only refer to `$` and `$root`. Queries of `$params` must start
+// with the name of a declared parameter, so `$params.tennat` is an error.
+//
+// Operators
+//
+// Numbers can be combined using the arithmetic operators `+`, `-`, `*`, `/` and
+// `%`, and negated using a unary `-`. Multiplication, division and remainder
+// take precedence over addition and subtraction, and parentheses can be used for
+// grouping:
+//     { "total": ($.price - $.discount) * $.quantity }
+// All operands must be numbers, anything else, including null, is an error.
+// Numbers are computed as float64, unless either operand is a json.Number (see
+// the UseNumber field of Template). In that case, the result is a json.Number,
+// computed exactly if both operands are integers and the result fits in an
+// int64. Number literals follow the JSON grammar, including exponents like in
+// `2.5e-3`, except that a leading zero may be left out, as in `.5`. Integer
+// literals too large to be represented exactly as a float64 are kept as
+// json.Number, so they are rendered exactly as written.
+//
+// Values can be compared using the operators `==`, `!=`, `<`, `<=`, `>` and
+// `>=`. Equality follows JSON semantics, so numbers are equal if their values
+// are, and arrays and objects are equal if all their elements or members are.
+// The ordering operators can only be applied to two numbers or two strings.
+// Conditions can be combined using the boolean operators `&&`, `||` and `!`,
+// which follow the same rules of truth as conditionals and yield true or false.
+// The right operand of `&&` and `||` is only evaluated if needed:
+//     if $.count > 0 && !$.hidden then $.items else []
+//
+// To fall back to a default for null or missing values, use `??`. It evaluates
+// to its left operand unless that is null, in which case the right operand is
+// evaluated instead. Missing keys in a query to the left of `??` are treated as
+// null even if the template is rendered with ErrorOnMissing.
+//     $.nickname ?? $.name ?? "anonymous"
+//
+// The `??` operator binds the loosest, followed by the boolean operators, with
+// `||` looser than `&&`, then the comparison operators and finally the
+// arithmetic operators.
+//
+// Template strings
+//
+// Strings can be composed from input data using template strings. These are
+// written within backticks, with each value to insert enclosed in `${` and `}`:
+//     { "url": `https://example.com/users/${$.user.id}/orders` }
+// Strings are inserted as they are, while all other values are formatted as
+// JSON. That is, numbers are formatted like in the JSON output, booleans as
+// `true` or `false`, null as `null`, and objects and arrays as compact JSON.
+// Template strings may span multiple lines. To insert a literal backtick, `$` or
+// backslash, precede it with a backslash. Includes can't be used within the
+// placeholders of template strings.
+//
 // Functions
 //
 // Regular Go functions can be exposed to and called from within the template.
@@ -131,6 +849,65 @@ func ParseString(s string, funcs FunctionMap) (*Template, error) {
 // introduced as follows:
 //     { "foo": Coalesce($.some_input, "default value") }
 //
+// To make chains of function calls easier to read, a value can be piped into a
+// function using `|`, which passes it as the first argument. The parentheses
+// may be omitted if there are no other arguments. The following is equivalent
+// to Trim(ToLower(Coalesce($.name, ""))):
+//     $.name | Coalesce("") | ToLower | Trim
+// Pipes bind more loosely than any other operator, so the entire expression to
+// the left of a `|` is passed to the function.
+//
+// Functions may also take sub-templates as arguments, written as lambdas. A
+// lambda lists its parameters followed by `=>` and the sub-template, which is
+// evaluated each time the function calls it. Within it, `$` refers to the first
+// argument of the call. This allows functions like Map, Filter and Reduce to be
+// implemented in Go:
+//     Map($.items, $item => $item.price * 2)
+//     Reduce($.items, 0, ($sum, $item) => $sum + $item.price)
+// A function receives a lambda as a Lambda, or as any other function type with
+// a single return value that it has declared for the parameter.
+//
+// Functions that may be slow can take a context.Context as their first
+// parameter, before those of the arguments in the template. They are then passed
+// the context given to RenderContext and the other methods taking one, or the
+// background context when rendering without one.
+//
+// Definitions
+//
+// Fragments used in several places can be defined once at the top of the
+// template, and then called like functions. Definitions take any number of
+// parameters, which are variables in scope of the body:
+//     def money($amount, $currency) { "amount": $amount, "currency": $currency }
+//     {
+//         "price": money($.price, "EUR"),
+//         "shipping": money($.shipping, "EUR"),
+//     }
+// The body is evaluated with the same `$` as the call. Other than the
+// parameters, only `$root` and `$params` are in scope of the body. A definition
+// hides any function with the same name in the FunctionMap.
+//
+// Definitions may call themselves and each other recursively, which allows
+// transforming tree-shaped input of any depth:
+//     def category($c) {
+//         "name": $c.title,
+//         "children": range $c.subcategories[*] [ category($) ],
+//     }
+//     category($.root_category)
+// Rendering fails if the calls are nested deeper than the MaxDepth of the
+// template.
+//
+// Includes
+//
+// Templates can share fragments by including other template definitions:
+//     { "address": include "fragments/address.tmpl" }
+// The included template is inserted in place of the include, and evaluated with
+// the same `$`. It does not see any variables or definitions declared in the
+// including template, other than `$root` and `$params`, and it cannot declare
+// parameters of its own. Paths are resolved relative to the directory of the
+// including file, using the Loader passed to ParseFile. Templates read by Parse
+// can therefore not contain includes. Includes are resolved when the template
+// is parsed, and a template may not include itself, directly or indirectly.
+//
 // Field annotations
 //
 // Members in objects can be prefixed with an annotation, starting with an `@`
@@ -149,9 +926,22 @@ func ParseString(s string, funcs FunctionMap) (*Template, error) {
 // Anything from and including this character to the end of the line will be
 // ignored when parsing the template.
 //
+// The members of objects are rendered in the order they are written in the
+// template, or generated by generators and spreads. Objects taken from the input
+// data as they are have their members sorted by key. The same order is used
+// when ranging over the members of an object and when formatting it in a
+// template string. As Go maps don't keep the order of their keys, it is only
+// retained by RenderJSON and by Render if the OrderedObjects field of the
+// template is set.
+//
 // Finally, unlike JSON, the template format tolerates trailing commas after the
 // last element of objects and arrays.
 func Parse(r io.Reader, funcs FunctionMap) (t *Template, err error) {
+	var b = builder{funcs: funcs, vars: globalVariables}
+	return b.parse(r)
+}
+
+func (b *builder) parse(r io.Reader) (t *Template, err error) {
 	var ast parse.Template
 	if err := parse.Parser.Parse(r, &ast); err != nil {
 		return nil, fmt.Errorf("jsontemplate: parse error: %v", err)
@@ -168,6 +958,39 @@ func Parse(r io.Reader, funcs FunctionMap) (t *Template, err error) {
 			panic(fmt.Sprintf("jsontemplate: panic during parsing: %v", r))
 		}
 	}()
-	var b = builder{funcs: funcs}
-	return &Template{definition: b.buildValue(&ast.Root)}, nil
+	// The parameters are built first, so that queries of them can be checked.
+	var res = &Template{params: b.buildParams(ast.Params)}
+	res.definition = b.buildTemplate(&ast)
+	return res, nil
+}
+
+// buildParams builds the parameters of a template. Their default values are
+// evaluated against the input data, so only `$` and `$root` are in scope of
+// them.
+func (b *builder) buildParams(nodes []parse.Param) []param {
+	var res []param
+	var outer = b.vars
+	b.vars = []string{rootVariable}
+	defer func() { b.vars = outer }()
+	for _, node := range nodes {
+		if b.declaredParam(node.Name) {
+			panic(fmt.Errorf("jsontemplate: parameter %s is declared more than once", node.Name))
+		}
+		var p = param{name: node.Name}
+		if node.Default != nil {
+			p.defaultValue = b.buildExpression(node.Default)
+		}
+		res = append(res, p)
+		b.params = append(b.params, node.Name)
+	}
+	return res
+}
+
+func (b *builder) declaredParam(name string) bool {
+	for _, p := range b.params {
+		if p == name {
+			return true
+		}
+	}
+	return false
 }
@@ -3,7 +3,9 @@ package jsontemplate
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	"k8s.io/client-go/util/jsonpath"
 )
@@ -64,8 +66,8 @@ func TestParseString(t *testing.T) {
 			`,
 			wantOut: &Template{
 				definition: object{
-					"foo": field{value: boolConstant(true)},
-					"bar": field{value: numberConstant(123)},
+					field{key: "foo", value: boolConstant(true)},
+					field{key: "bar", value: numberConstant(123)},
 				},
 			},
 		},
@@ -74,13 +76,278 @@ func TestParseString(t *testing.T) {
 			definition: `{@deprecated "foo": true}`,
 			wantOut: &Template{
 				definition: object{
-					"foo": field{
+					field{
+						key:        "foo",
 						value:      boolConstant(true),
 						annotation: "deprecated",
 					},
 				},
 			},
 		},
+		{
+			name:       "conditional",
+			definition: `if true then "yes" else $.foo`,
+			wantOut: &Template{
+				definition: conditional{
+					condition: boolConstant(true),
+					then:      stringConstant("yes"),
+					otherwise: query{expression: mustParseJSONPath("$.foo")},
+				},
+			},
+		},
+		{
+			name:       "let",
+			definition: `let $x = $.foo in [$x, $x.bar]`,
+			wantOut: &Template{
+				definition: let{
+					names:  []string{"x"},
+					values: []template{query{expression: mustParseJSONPath("$.foo")}},
+					body: array{
+						query{variable: "x"},
+						query{variable: "x", expression: mustParseJSONPath("$.bar")},
+					},
+				},
+			},
+		},
+		{
+			name:       "undefined variable",
+			definition: `let $x = $.foo in $y`,
+			wantErr:    true,
+		},
+		{
+			name:       "variable out of scope",
+			definition: `[let $x = $.foo in $x, $x]`,
+			wantErr:    true,
+		},
+		{
+			name:       "backslash in quoted key",
+			definition: `$["a\\b"]`,
+			wantErr:    true,
+		},
+		{
+			name:       "backslash in dotted key",
+			definition: `$.a\\b`,
+			wantErr:    true,
+		},
+		{
+			name:       "invalid variable name",
+			definition: `let $x.y = $.foo in $x`,
+			wantErr:    true,
+		},
+		{
+			name:       "generator variable",
+			definition: `range $x in $root.foo[*] [$x.bar]`,
+			wantOut: &Template{
+				definition: generator{
+					over:     query{variable: "root", expression: mustParseJSONPath("$.foo[*]")},
+					variable: "x",
+					template: query{variable: "x", expression: mustParseJSONPath("$.bar")},
+				},
+			},
+		},
+		{
+			name:       "generator variable out of scope",
+			definition: `[range $x in $.foo[*] [$x], $x]`,
+			wantErr:    true,
+		},
+		{
+			name:       "redeclared root",
+			definition: `let $root = 1 in $root`,
+			wantErr:    true,
+		},
+		{
+			name:       "redeclared params",
+			definition: `let $params = 1 in $params`,
+			wantErr:    true,
+		},
+		{
+			name:       "duplicate param",
+			definition: `param a param a $params.a`,
+			wantErr:    true,
+		},
+		{
+			name:       "param default out of scope",
+			definition: `param a param b = $params.a $params.b`,
+			wantErr:    true,
+		},
+		{
+			name:       "param query",
+			definition: `param a [$params, $params.a.b, $params['a']]`,
+			wantOut: &Template{
+				params: []param{{name: "a"}},
+				definition: array{
+					query{variable: "params"},
+					query{variable: "params", expression: mustParseJSONPath("$.a.b")},
+					query{variable: "params", expression: mustParseJSONPath("$.a")},
+				},
+			},
+		},
+		{
+			name:       "undefined param",
+			definition: `param tenant $params.tenat`,
+			wantErr:    true,
+		},
+		{
+			name:       "undefined param in brackets",
+			definition: `param tenant $params["tenat"]`,
+			wantErr:    true,
+		},
+		{
+			name:       "param wildcard",
+			definition: `param tenant $params.*`,
+			wantErr:    true,
+		},
+		{
+			name:       "object generator",
+			definition: `range $.foo[*] { $.id: $.bar }`,
+			wantOut: &Template{
+				definition: generator{
+					over:      query{expression: mustParseJSONPath("$.foo[*]")},
+					memberKey: query{expression: mustParseJSONPath("$.id")},
+					template:  query{expression: mustParseJSONPath("$.bar")},
+				},
+			},
+		},
+		{
+			name:       "spread",
+			definition: `{...$.foo, "bar": [...$.bar, 1]}`,
+			wantOut: &Template{
+				definition: object{
+					field{value: spread{query{expression: mustParseJSONPath("$.foo")}}},
+					field{key: "bar", value: array{
+						spread{query{expression: mustParseJSONPath("$.bar")}},
+						numberConstant(1),
+					}},
+				},
+			},
+		},
+		{
+			name:       "operators",
+			definition: `[-1, 1 - 2 - 3 * -$.foo % 4, (1 - 2) - -(3)]`,
+			wantOut: &Template{
+				definition: array{
+					numberConstant(-1),
+					binaryOperation{
+						operator: "-",
+						left: binaryOperation{
+							operator: "-",
+							left:     numberConstant(1),
+							right:    numberConstant(2),
+						},
+						right: binaryOperation{
+							operator: "%",
+							left: binaryOperation{
+								operator: "*",
+								left:     numberConstant(3),
+								right: unaryOperation{
+									operator: "-",
+									operand:  query{expression: mustParseJSONPath("$.foo")},
+								},
+							},
+							right: numberConstant(4),
+						},
+					},
+					binaryOperation{
+						operator: "-",
+						left: binaryOperation{
+							operator: "-",
+							left:     numberConstant(1),
+							right:    numberConstant(2),
+						},
+						right: numberConstant(-3),
+					},
+				},
+			},
+		},
+		{
+			name:       "computed key",
+			definition: `{[$.a]: 1}`,
+			wantOut: &Template{
+				definition: object{
+					field{computedKey: query{expression: mustParseJSONPath("$.a")}, value: numberConstant(1)},
+				},
+			},
+		},
+		{
+			name:       "boolean operators",
+			definition: `!$.a || $.b + 1 > 2 && $.c == "foo"`,
+			wantOut: &Template{
+				definition: binaryOperation{
+					operator: "||",
+					left: unaryOperation{
+						operator: "!",
+						operand:  query{expression: mustParseJSONPath("$.a")},
+					},
+					right: binaryOperation{
+						operator: "&&",
+						left: binaryOperation{
+							operator: ">",
+							left: binaryOperation{
+								operator: "+",
+								left:     query{expression: mustParseJSONPath("$.b")},
+								right:    numberConstant(1),
+							},
+							right: numberConstant(2),
+						},
+						right: binaryOperation{
+							operator: "==",
+							left:     query{expression: mustParseJSONPath("$.c")},
+							right:    stringConstant("foo"),
+						},
+					},
+				},
+			},
+		},
+		{
+			name:       "coalesce",
+			definition: `$.a ?? $.b ?? 1 + 2`,
+			wantOut: &Template{
+				definition: binaryOperation{
+					operator: "??",
+					left:     query{expression: mustParseJSONPath("$.a")},
+					right: binaryOperation{
+						operator: "??",
+						left:     query{expression: mustParseJSONPath("$.b")},
+						right: binaryOperation{
+							operator: "+",
+							left:     numberConstant(1),
+							right:    numberConstant(2),
+						},
+					},
+				},
+			},
+		},
+		{
+			name:       "match",
+			definition: `match $.a { "b": 1, _: 2, }`,
+			wantOut: &Template{
+				definition: match{
+					value:     query{expression: mustParseJSONPath("$.a")},
+					patterns:  []template{stringConstant("b")},
+					arms:      []template{numberConstant(1)},
+					otherwise: numberConstant(2),
+				},
+			},
+		},
+		{
+			name:       "numbers",
+			definition: `[1.5, 2.5e-3, -1E6, 9007199254740993, -9223372036854775809, --9007199254740993]`,
+			wantOut: &Template{
+				definition: array{
+					numberConstant(1.5),
+					numberConstant(0.0025),
+					numberConstant(-1e6),
+					integerConstant("9007199254740993"),
+					integerConstant("-9223372036854775809"),
+					integerConstant("9007199254740993"),
+				},
+			},
+		},
+		{
+			name:       "number out of range",
+			definition: `1e400`,
+			wantErr:    true,
+		},
 		// Note: Functions are not comparable in Go, so it we can't test using
 		//       one here in any way that isn't already covered elsewhere. But
 		//       we can test the error handling of missing ones.
@@ -89,12 +356,68 @@ func TestParseString(t *testing.T) {
 			definition: `missing("foo", "bar")`,
 			wantErr:    true,
 		},
+		{
+			name:       "group without by",
+			definition: `group $.foo[*] [$]`,
+			wantErr:    true,
+		},
+		{
+			name:       "range with by",
+			definition: `range $.foo[*] by $.bar [$]`,
+			wantErr:    true,
+		},
+		{
+			name:       "group key scope",
+			definition: `group $k, $g in $.foo[*] by $k [$]`,
+			wantErr:    true,
+		},
+		{
+			name:       "definition arguments",
+			definition: `def foo($a) $a foo(1, 2)`,
+			wantErr:    true,
+		},
+		{
+			name:       "definition scope",
+			definition: `let $x = 1 in def foo() $x foo()`,
+			wantErr:    true,
+		},
+		{
+			name:       "duplicate definition",
+			definition: `def foo() 1 def foo() 2 foo()`,
+			wantErr:    true,
+		},
+		{
+			name:       "lambda outside function",
+			definition: `{"foo": $x => $x}`,
+			wantErr:    true,
+		},
+		{
+			name:       "lambda passed to definition",
+			definition: `def foo($f) $f foo($x => $x)`,
+			wantErr:    true,
+		},
+		{
+			name:       "match default not last",
+			definition: `match $.a { _: 1, "b": 2 }`,
+			wantErr:    true,
+		},
+		{
+			name:       "include without loader",
+			definition: `include "foo.tmpl"`,
+			wantErr:    true,
+		},
+		{
+			name:       "missing piped function",
+			definition: `$.foo | missing`,
+			wantErr:    true,
+		},
 		{
 			name:       "jsonpath",
 			definition: `{"foo": $.foo.bar[234]..baz[*]}`,
 			wantOut: &Template{
 				definition: object{
-					"foo": field{
+					field{
+						key: "foo",
 						value: query{
 							expression: mustParseJSONPath("$.foo.bar[234]..baz[*]"),
 						},
@@ -122,20 +445,21 @@ func TestParseString(t *testing.T) {
 			`,
 			wantOut: &Template{
 				definition: object{
-					"foo": field{value: array{
+					field{key: "foo", value: array{
 						numberConstant(123),
 						object{
-							"baz": field{
+							field{
+								key: "baz",
 								value: generator{
 									over: query{expression: mustParseJSONPath("$..stuff")},
 									template: object{
-										"x": field{value: nullConstant{}},
-										"y": field{value: query{expression: mustParseJSONPath("$.hello[1:5]")}},
+										field{key: "x", value: nullConstant{}},
+										field{key: "y", value: query{expression: mustParseJSONPath("$.hello[1:5]")}},
 									},
 								},
 								annotation: "deprecated",
 							},
-							"something": field{value: stringConstant("with trailing comma")},
+							field{key: "something", value: stringConstant("with trailing comma")},
 						},
 					}},
 				},
@@ -155,3 +479,102 @@ func TestParseString(t *testing.T) {
 		})
 	}
 }
+
+func TestParseFile(t *testing.T) {
+	var fsys = fstest.MapFS{
+		"main.tmpl": {Data: []byte(`
+			{
+				"name": $.name,
+				"address": include "fragments/address.tmpl",
+			}
+		`)},
+		"fragments/address.tmpl": {Data: []byte(`[$.city, include "country.tmpl"]`)},
+		"fragments/country.tmpl": {Data: []byte(`$root.country`)},
+		"missing.tmpl":           {Data: []byte("[\n  include \"nowhere.tmpl\"\n]")},
+		"broken.tmpl":            {Data: []byte(`include "fragments/broken.tmpl"`)},
+		"fragments/broken.tmpl":  {Data: []byte(`{"foo": }`)},
+		"cycle.tmpl":             {Data: []byte(`{"foo": include "fragments/cycle.tmpl"}`)},
+		"fragments/cycle.tmpl":   {Data: []byte(`[include "../cycle.tmpl"]`)},
+		"scope.tmpl":             {Data: []byte(`let $x = 1 in include "fragments/scope.tmpl"`)},
+		"fragments/scope.tmpl":   {Data: []byte(`$x`)},
+		"params.tmpl":            {Data: []byte(`include "fragments/params.tmpl"`)},
+		"fragments/params.tmpl":  {Data: []byte(`param x $params.x`)},
+		"param.tmpl":             {Data: []byte(`param x = $.name include "fragments/param.tmpl"`)},
+		"fragments/param.tmpl":   {Data: []byte(`[$params.x]`)},
+		"noparam.tmpl":           {Data: []byte(`param x = $.name include "fragments/noparam.tmpl"`)},
+		"fragments/noparam.tmpl": {Data: []byte(`$params.y`)},
+		"fragments/string.tmpl":  {Data: []byte("[include \"country.tmpl\", `${include \"country.tmpl\"}`]")},
+	}
+	tests := []struct {
+		name    string
+		file    string
+		wantRes interface{}
+		wantErr string
+	}{
+		{
+			name: "nested includes",
+			file: "main.tmpl",
+			wantRes: map[string]interface{}{
+				"name":    "foo",
+				"address": []interface{}{"bar", "baz"},
+			},
+		},
+		{
+			name:    "missing file",
+			file:    "missing.tmpl",
+			wantErr: `jsontemplate: missing.tmpl:2:3: cannot include "nowhere.tmpl": open nowhere.tmpl: file does not exist`,
+		},
+		{
+			name:    "parse error",
+			file:    "broken.tmpl",
+			wantErr: "jsontemplate: broken.tmpl:1:1: parse error in included file: fragments/broken.tmpl:1:9:",
+		},
+		{
+			name:    "cycle",
+			file:    "cycle.tmpl",
+			wantErr: "jsontemplate: fragments/cycle.tmpl:1:2: include cycle: cycle.tmpl -> fragments/cycle.tmpl -> cycle.tmpl",
+		},
+		{
+			name:    "separate scope",
+			file:    "scope.tmpl",
+			wantErr: "jsontemplate: undefined variable: $x",
+		},
+		{
+			name:    "params of including file",
+			file:    "param.tmpl",
+			wantRes: []interface{}{"foo"},
+		},
+		{
+			name:    "undefined param in include",
+			file:    "noparam.tmpl",
+			wantErr: "jsontemplate: undefined parameter: $params.y",
+		},
+		{
+			name:    "include in template string",
+			file:    "fragments/string.tmpl",
+			wantErr: "jsontemplate: parse error: fragments/string.tmpl:1:26: parse.Value.Interpolation: includes are not allowed",
+		},
+		{
+			name:    "params in include",
+			file:    "params.tmpl",
+			wantErr: "jsontemplate: params.tmpl:1:1: parameters cannot be declared in included file fragments/params.tmpl",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templ, err := ParseFile(FSLoader(fsys), tt.file, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Errorf("ParseFile() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("ParseFile() error = %v", err)
+			}
+			var data = map[string]interface{}{"name": "foo", "city": "bar", "country": "baz"}
+			if gotRes, err := templ.Render(data); err != nil || !reflect.DeepEqual(gotRes, tt.wantRes) {
+				t.Errorf("Template.Render() = %v, %v, want %v", gotRes, err, tt.wantRes)
+			}
+		})
+	}
+}
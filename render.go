@@ -1,12 +1,16 @@
 package jsontemplate
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
 	"runtime"
 	"runtime/debug"
+	"sort"
+	"strings"
 
 	"k8s.io/client-go/util/jsonpath"
 )
@@ -25,8 +29,75 @@ const (
 	ErrorOnMissing
 )
 
+// DuplicateKeyPolicy dictates how the rendering should handle objects where
+// several members are generated with the same key.
+type DuplicateKeyPolicy int
+
+const (
+	// LastKeyWins makes a generated member replace any earlier member with the
+	// same key.
+	LastKeyWins DuplicateKeyPolicy = iota
+
+	// ErrorOnDuplicate causes the renderer to return an error if several
+	// members of an object are generated with the same key.
+	ErrorOnDuplicate
+)
+
 type options struct {
-	MissingKeys MissingKeyPolicy
+	MissingKeys   MissingKeyPolicy
+	DuplicateKeys DuplicateKeyPolicy
+	MaxDepth      int
+
+	ctx   context.Context // Background unless rendered with a context.
+	vars  *binding        // Variables in scope, innermost first.
+	depth int             // Number of nested calls to definitions.
+	order keyOrder        // Records the order of generated objects, if set.
+}
+
+// checkContext stops the rendering if its context is done.
+func (opt options) checkContext() {
+	if err := opt.ctx.Err(); err != nil {
+		panic(fmt.Errorf("jsontemplate: rendering interrupted: %w", err))
+	}
+}
+
+// DefaultMaxDepth is the maximum depth of nested calls to definitions, unless
+// the template specifies otherwise.
+const DefaultMaxDepth = 1000
+
+// rootVariable is the name of the variable bound to the input data.
+const rootVariable = "root"
+
+// paramsVariable is the name of the variable bound to the parameters of the
+// template.
+const paramsVariable = "params"
+
+// binding is a variable in scope during interpolation. Its value is computed
+// the first time it is used.
+type binding struct {
+	name   string
+	value  interface{}
+	eval   func() interface{} // Nil once the value has been computed.
+	parent *binding
+}
+
+func (b *binding) lookup(name string) interface{} {
+	for ; b != nil; b = b.parent {
+		if b.name == name {
+			if b.eval != nil {
+				b.value, b.eval = b.eval(), nil
+			}
+			return b.value
+		}
+	}
+	// The parser checks that all variables are declared, so this is a bug.
+	panic(fmt.Sprintf("jsontemplate: undefined variable $%s", name))
+}
+
+// bind returns a copy of the options with a variable added to the scope.
+func (opt options) bind(name string, eval func() interface{}) options {
+	opt.vars = &binding{name: name, eval: eval, parent: opt.vars}
+	return opt
 }
 
 type template interface {
@@ -38,22 +109,107 @@ type boolConstant bool
 type numberConstant float64
 type nullConstant struct{}
 
-type object map[string]field
+// integerConstant is an integer literal too large to be represented exactly as
+// a float64.
+type integerConstant json.Number
+
+type object []field
 
 type field struct {
-	value      template
-	annotation string
+	key         string   // Unused for spreads.
+	computedKey template // Replaces key if not nil.
+	value       template
+	annotation  string
 }
 
 type array []template
 
+// spread is a value whose members or elements are inserted into the enclosing
+// object or array.
+type spread struct {
+	value template
+}
+
 type query struct {
-	expression *jsonpath.JSONPath
+	variable   string             // Queries `$` if empty.
+	expression *jsonpath.JSONPath // Nil for plain variable references.
 }
 
 type generator struct {
-	over     query
-	template template
+	over      query
+	key       string   // Name of the variable bound to each index or key, if any.
+	members   bool     // Ranges over the members of an object yielded by the query.
+	variable  string   // Name of the variable bound to each element, if any.
+	groupBy   template // Ranges over groups of elements with equal keys, if set.
+	where     template // Filters the elements, if set.
+	orderBy   []ordering
+	limit     template // Evaluated against the input of the generator.
+	offset    template // Evaluated against the input of the generator.
+	memberKey template // Generates an object rather than an array, if set.
+	template  template
+}
+
+type ordering struct {
+	key        template
+	descending bool
+}
+
+// element is an element in the range of a generator, with the options to
+// interpolate templates for it with.
+type element struct {
+	value    interface{}
+	opt      options
+	sortKeys []interface{}
+}
+
+type conditional struct {
+	condition template
+	then      template
+	otherwise template
+}
+
+type match struct {
+	value     template
+	patterns  []template
+	arms      []template
+	otherwise template // Nil if there is no default arm.
+}
+
+type let struct {
+	names  []string
+	values []template
+	body   template
+}
+
+type templateString struct {
+	parts  []string // One more than the number of values.
+	values []template
+}
+
+// lambda is a sub-template passed as an argument to a function.
+type lambda struct {
+	params []string
+	body   template
+}
+
+// Lambda is a sub-template passed as an argument to a function in the
+// FunctionMap. Calling it renders the sub-template with `$` referring to the
+// first argument, and the parameters of the lambda bound to the arguments in
+// order. Functions may declare lambda parameters either as a Lambda, or as
+// any other function type with a single return value, to which the lambda
+// is adapted.
+type Lambda func(args ...interface{}) interface{}
+
+// definition is a named sub-template taking parameters.
+type definition struct {
+	name   string
+	params []string
+	body   template // Set after all definitions are declared.
+}
+
+type call struct {
+	definition *definition
+	args       []template
 }
 
 type function struct {
@@ -62,28 +218,96 @@ type function struct {
 	args     []template
 }
 
+// contextType is the type of the first parameter of functions that take the
+// context of the rendering.
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 func (s stringConstant) interpolate(data interface{}, opt options) interface{} { return string(s) }
 func (b boolConstant) interpolate(data interface{}, opt options) interface{}   { return bool(b) }
 func (n numberConstant) interpolate(data interface{}, opt options) interface{} { return float64(n) }
 func (n nullConstant) interpolate(data interface{}, opt options) interface{}   { return nil }
+func (n integerConstant) interpolate(data interface{}, opt options) interface{} {
+	return json.Number(n)
+}
 
 func (o object) interpolate(data interface{}, opt options) interface{} {
-	var res = make(map[string]interface{})
-	for name, field := range o {
-		res[name] = field.value.interpolate(data, opt)
+	var res = make(map[string]interface{}, len(o))
+	var order []string
+	var set = func(key string, val interface{}) {
+		if _, ok := res[key]; !ok {
+			order = append(order, key)
+		}
+		res[key] = val
 	}
+	// Spreading may replace members with the same key, so only the keys of
+	// the other members are checked for duplicates.
+	var named map[string]bool
+	if opt.DuplicateKeys == ErrorOnDuplicate {
+		named = make(map[string]bool, len(o))
+	}
+	for _, field := range o {
+		var key = field.key
+		if field.computedKey != nil {
+			key = memberName(field.computedKey.interpolate(data, opt))
+		}
+		if _, ok := field.value.(spread); !ok {
+			if named != nil {
+				if named[key] {
+					panic(fmt.Errorf("jsontemplate: duplicate key in object: %q", key))
+				}
+				named[key] = true
+			}
+			set(key, field.value.interpolate(data, opt))
+			continue
+		}
+		var val = field.value.interpolate(data, opt)
+		if val == nil {
+			continue
+		}
+		var keys, values = opt.order.members(val)
+		if keys == nil {
+			panic(fmt.Errorf("jsontemplate: cannot spread %v (%T) into an object", val, val))
+		}
+		for i, key := range keys {
+			set(key.(string), values[i].Interface())
+		}
+	}
+	opt.order.record(res, order)
 	return res
 }
 
 func (a array) interpolate(data interface{}, opt options) interface{} {
-	var res = make([]interface{}, len(a))
-	for i, templ := range a {
-		res[i] = templ.interpolate(data, opt)
+	var res = make([]interface{}, 0, len(a))
+	for _, templ := range a {
+		var val = templ.interpolate(data, opt)
+		if _, ok := templ.(spread); !ok {
+			res = append(res, val)
+			continue
+		} else if val == nil {
+			continue
+		}
+		var elems = reflect.ValueOf(val)
+		if kind := elems.Kind(); kind != reflect.Slice && kind != reflect.Array {
+			panic(fmt.Errorf("jsontemplate: cannot spread %v (%T) into an array", val, val))
+		}
+		for i := 0; i < elems.Len(); i++ {
+			res = append(res, elems.Index(i).Interface())
+		}
 	}
 	return res
 }
 
+func (s spread) interpolate(data interface{}, opt options) interface{} {
+	return s.value.interpolate(data, opt)
+}
+
 func (q query) interpolate(data interface{}, opt options) interface{} {
+	if q.variable != "" {
+		data = opt.vars.lookup(q.variable)
+		if q.expression == nil {
+			return data
+		}
+	}
 	if data == nil {
 		switch opt.MissingKeys {
 		case NullOnMissing:
@@ -92,27 +316,43 @@ func (q query) interpolate(data interface{}, opt options) interface{} {
 			panic(fmt.Errorf("jsontemplate: cannot execute query, input is null"))
 		}
 	}
-	q.expression.AllowMissingKeys(opt.MissingKeys == NullOnMissing)
-	var hits, err = q.expression.FindResults(data)
-	if err != nil {
-		panic(fmt.Errorf("jsontemplate: error executing query: %v", err))
-	}
-	switch len(hits[0]) {
+	var hits = q.find(data, opt)
+	switch len(hits) {
 	case 0:
 		return nil
 	case 1:
-		return hits[0][0].Interface()
+		return hits[0].Interface()
 	default: // Many, make an array.
-		var res = make([]interface{}, len(hits[0]))
-		for i, v := range hits[0] {
+		var res = make([]interface{}, len(hits))
+		for i, v := range hits {
 			res[i] = v.Interface()
 		}
 		return res
 	}
 }
 
+// find executes the query expression on non-nil data.
+func (q query) find(data interface{}, opt options) []reflect.Value {
+	if q.expression == nil {
+		return []reflect.Value{reflect.ValueOf(data)}
+	}
+	// The expression keeps state while it is executed, so each execution uses
+	// a copy of it to allow rendering a template concurrently.
+	var expression = *q.expression
+	expression.AllowMissingKeys(opt.MissingKeys == NullOnMissing)
+	var hits, err = expression.FindResults(data)
+	if err != nil {
+		panic(fmt.Errorf("jsontemplate: error executing query: %v", err))
+	}
+	return hits[0]
+}
+
 func (g generator) interpolate(data interface{}, opt options) interface{} {
-	if data == nil {
+	var input = data
+	if g.over.variable != "" {
+		input = opt.vars.lookup(g.over.variable)
+	}
+	if input == nil {
 		switch opt.MissingKeys {
 		case NullOnMissing:
 			return nil
@@ -120,43 +360,344 @@ func (g generator) interpolate(data interface{}, opt options) interface{} {
 			panic(fmt.Errorf("jsontemplate: cannot generate array, input is null"))
 		}
 	}
-	g.over.expression.AllowMissingKeys(opt.MissingKeys == NullOnMissing)
-	var hits, err = g.over.expression.FindResults(data)
-	if err != nil {
-		panic(err)
+	var hits = g.over.find(input, opt)
+	var keys []interface{}
+	if g.groupBy != nil {
+		keys, hits = g.group(hits, opt)
+	} else if g.members && len(hits) == 1 && hits[0].IsValid() {
+		keys, hits = opt.order.members(hits[0].Interface())
 	}
-	var res = make([]interface{}, len(hits[0]))
-	for i, v := range hits[0] {
+	var elems = make([]element, 0, len(hits))
+	for i, v := range hits {
+		opt.checkContext()
 		var inner interface{}
 		if v.IsValid() {
 			inner = v.Interface()
 		}
-		res[i] = g.template.interpolate(inner, opt)
+		var innerOpt = opt
+		if g.key != "" {
+			var key interface{} = float64(i)
+			if keys != nil {
+				key = keys[i]
+			}
+			innerOpt = innerOpt.bind(g.key, func() interface{} { return key })
+		}
+		if g.variable != "" {
+			innerOpt = innerOpt.bind(g.variable, func() interface{} { return inner })
+		}
+		if g.where != nil && !truthy(g.where.interpolate(inner, innerOpt)) {
+			continue
+		}
+		elems = append(elems, element{value: inner, opt: innerOpt})
 	}
-	return res
+	if len(g.orderBy) > 0 {
+		g.sort(elems)
+	}
+	elems = g.paginate(elems, data, opt)
+
+	if g.memberKey == nil {
+		var res = make([]interface{}, len(elems))
+		for i, e := range elems {
+			opt.checkContext()
+			res[i] = g.template.interpolate(e.value, e.opt)
+		}
+		return res
+	}
+	var obj = make(map[string]interface{}, len(elems))
+	var order []string
+	for _, e := range elems {
+		opt.checkContext()
+		var name = memberName(g.memberKey.interpolate(e.value, e.opt))
+		if _, ok := obj[name]; !ok {
+			order = append(order, name)
+		} else if opt.DuplicateKeys == ErrorOnDuplicate {
+			panic(fmt.Errorf("jsontemplate: duplicate key in generated object: %q", name))
+		}
+		obj[name] = g.template.interpolate(e.value, e.opt)
+	}
+	opt.order.record(obj, order)
+	return obj
+}
+
+// group partitions the elements of a generator into arrays of elements with
+// equal keys, in the order the keys first appear.
+func (g generator) group(hits []reflect.Value, opt options) (keys []interface{}, groups []reflect.Value) {
+	var elems [][]interface{}
+	var index = make(map[string][]int) // Groups by the hash of their keys.
+	for _, v := range hits {
+		var elem interface{}
+		if v.IsValid() {
+			elem = v.Interface()
+		}
+		var key = g.groupBy.interpolate(elem, opt)
+		var hash strings.Builder
+		hashKey(&hash, key)
+		var i = -1
+		for _, j := range index[hash.String()] {
+			if equal(keys[j], key) {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			i = len(keys)
+			keys = append(keys, key)
+			elems = append(elems, nil)
+			index[hash.String()] = append(index[hash.String()], i)
+		}
+		elems[i] = append(elems[i], elem)
+	}
+	groups = make([]reflect.Value, len(elems))
+	for i, e := range elems {
+		groups[i] = reflect.ValueOf(e)
+	}
+	return keys, groups
+}
+
+// sort sorts the elements of a generator by its ordering keys. Elements with
+// equal keys keep their relative order. Null is ordered before any other value.
+func (g generator) sort(elems []element) {
+	for i, e := range elems {
+		elems[i].sortKeys = make([]interface{}, len(g.orderBy))
+		for j, o := range g.orderBy {
+			elems[i].sortKeys[j] = o.key.interpolate(e.value, e.opt)
+		}
+	}
+	sort.SliceStable(elems, func(i, j int) bool {
+		for k, o := range g.orderBy {
+			var a, b = elems[i].sortKeys[k], elems[j].sortKeys[k]
+			var cmp, ok = order(a, b)
+			switch {
+			case a == nil && b == nil:
+				cmp = 0
+			case a == nil:
+				cmp = -1
+			case b == nil:
+				cmp = 1
+			case !ok:
+				panic(fmt.Errorf("jsontemplate: cannot order %v (%T) and %v (%T)", a, a, b, b))
+			}
+			if o.descending {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+}
+
+// paginate applies the offset and limit of a generator to its elements.
+func (g generator) paginate(elems []element, data interface{}, opt options) []element {
+	if g.offset != nil {
+		var n = count("offset", g.offset.interpolate(data, opt))
+		if n > len(elems) {
+			n = len(elems)
+		}
+		elems = elems[n:]
+	}
+	if g.limit != nil {
+		var n = count("limit", g.limit.interpolate(data, opt))
+		if n < len(elems) {
+			elems = elems[:n]
+		}
+	}
+	return elems
+}
+
+// count checks that a value is a non-negative integer.
+func count(what string, v interface{}) int {
+	if n, ok := toInt(v); ok && 0 <= n && n <= math.MaxInt32 {
+		return int(n)
+	}
+	panic(fmt.Errorf("jsontemplate: %s must be a non-negative integer, got %v (%T)", what, v, v))
+}
+
+// memberName checks that an evaluated key of an object member is a string.
+func memberName(key interface{}) string {
+	if name, ok := key.(string); ok {
+		return name
+	}
+	panic(fmt.Errorf("jsontemplate: object key must be a string, got %v (%T)", key, key))
+}
+
+// members returns the keys and values of the members of an object, sorted by
+// key. If the value is not an object, it is returned as the only value, with no
+// keys.
+func members(v reflect.Value) (keys []interface{}, values []reflect.Value) {
+	if !v.IsValid() {
+		return nil, []reflect.Value{v}
+	}
+	var obj = reflect.ValueOf(v.Interface())
+	if obj.Kind() != reflect.Map || obj.Type().Key().Kind() != reflect.String {
+		return nil, []reflect.Value{v}
+	}
+	var names = make([]string, 0, obj.Len())
+	for _, k := range obj.MapKeys() {
+		names = append(names, k.String())
+	}
+	sort.Strings(names)
+	keys = make([]interface{}, len(names))
+	values = make([]reflect.Value, len(names))
+	for i, name := range names {
+		keys[i] = name
+		values[i] = obj.MapIndex(reflect.ValueOf(name).Convert(obj.Type().Key()))
+	}
+	return keys, values
+}
+
+// truthy reports whether a value is considered true when used as a condition.
+// Only null and false are considered false.
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	default:
+		return true
+	}
+}
+
+func (c conditional) interpolate(data interface{}, opt options) interface{} {
+	if truthy(c.condition.interpolate(data, opt)) {
+		return c.then.interpolate(data, opt)
+	}
+	return c.otherwise.interpolate(data, opt)
+}
+
+func (m match) interpolate(data interface{}, opt options) interface{} {
+	var val = m.value.interpolate(data, opt)
+	for i, pattern := range m.patterns {
+		if equal(val, pattern.interpolate(data, opt)) {
+			return m.arms[i].interpolate(data, opt)
+		}
+	}
+	if m.otherwise == nil {
+		panic(fmt.Errorf("jsontemplate: no arm of match for %v (%T)", val, val))
+	}
+	return m.otherwise.interpolate(data, opt)
+}
+
+func (l let) interpolate(data interface{}, opt options) interface{} {
+	for i, name := range l.names {
+		var value, outer = l.values[i], opt
+		opt = opt.bind(name, func() interface{} { return value.interpolate(data, outer) })
+	}
+	return l.body.interpolate(data, opt)
+}
+
+func (l lambda) interpolate(data interface{}, opt options) interface{} {
+	return Lambda(func(args ...interface{}) interface{} {
+		if len(args) != len(l.params) {
+			panic(fmt.Errorf("jsontemplate: lambda takes %d arguments, got %d", len(l.params), len(args)))
+		}
+		var inner = opt
+		for i, name := range l.params {
+			var arg = args[i]
+			inner = inner.bind(name, func() interface{} { return arg })
+		}
+		var self interface{}
+		if len(args) > 0 {
+			self = args[0]
+		}
+		return l.body.interpolate(self, inner)
+	})
+}
+
+// adapt wraps a lambda in a function of another type, passing the arguments on
+// and checking that the result can be returned.
+func (l Lambda) adapt(ftype reflect.Type) reflect.Value {
+	if ftype.NumOut() != 1 {
+		panic(fmt.Errorf("jsontemplate: cannot pass lambda as %v, expecting a single return value", ftype))
+	}
+	var out = ftype.Out(0)
+	return reflect.MakeFunc(ftype, func(in []reflect.Value) []reflect.Value {
+		var args []interface{}
+		for i, v := range in {
+			if ftype.IsVariadic() && i == len(in)-1 {
+				for j := 0; j < v.Len(); j++ {
+					args = append(args, v.Index(j).Interface())
+				}
+			} else {
+				args = append(args, v.Interface())
+			}
+		}
+		var res = l(args...)
+		if res == nil {
+			return []reflect.Value{reflect.Zero(out)}
+		} else if rval := reflect.ValueOf(res); rval.Type().AssignableTo(out) {
+			return []reflect.Value{rval}
+		}
+		panic(fmt.Errorf("jsontemplate: cannot return %v (%T) from lambda, expecting %v", res, res, out))
+	})
+}
+
+func (c call) interpolate(data interface{}, opt options) interface{} {
+	var max = opt.MaxDepth
+	if max == 0 {
+		max = DefaultMaxDepth
+	}
+	if opt.depth++; opt.depth > max {
+		panic(fmt.Errorf("jsontemplate: maximum depth of %d exceeded calling %s", max, c.definition.name))
+	}
+	opt.checkContext()
+	var outer = opt
+	for i, name := range c.definition.params {
+		var arg = c.args[i]
+		opt = opt.bind(name, func() interface{} { return arg.interpolate(data, outer) })
+	}
+	return c.definition.body.interpolate(data, opt)
+}
+
+func (s templateString) interpolate(data interface{}, opt options) interface{} {
+	var res strings.Builder
+	res.WriteString(s.parts[0])
+	for i, templ := range s.values {
+		switch val := templ.interpolate(data, opt).(type) {
+		case string:
+			res.WriteString(val)
+		default:
+			var text, err = opt.order.marshal(val)
+			if err != nil {
+				panic(fmt.Errorf("jsontemplate: cannot format %v (%T) in template string: %v", val, val, err))
+			}
+			res.Write(text)
+		}
+		res.WriteString(s.parts[i+1])
+	}
+	return res.String()
 }
 
 func (f function) interpolate(data interface{}, opt options) interface{} {
-	var args = make([]reflect.Value, len(f.args))
 	var ftype = reflect.TypeOf(f.function)
+	var args = make([]reflect.Value, 0, len(f.args)+1)
+	if ftype.NumIn() > 0 && ftype.In(0) == contextType {
+		// The context of the rendering is passed before the other arguments.
+		args = append(args, reflect.ValueOf(opt.ctx))
+	}
+	var first = len(args) // Index of the parameter of the first argument.
+	args = args[:first+len(f.args)]
 	for i, templ := range f.args {
+		var n = first + i
 		// The Call function of the reflect library doesn't handle nil
 		// interfaces the way we want (it will create an invalid Value) so we
 		// need some special handling of nil arguments here.
 		var val = templ.interpolate(data, opt)
 		var expected reflect.Type
-		if ftype.IsVariadic() && i >= ftype.NumIn()-1 {
+		if ftype.IsVariadic() && n >= ftype.NumIn()-1 {
 			// Variadic arguments are represented as a final array argument.
 			expected = ftype.In(ftype.NumIn() - 1).Elem()
 		} else {
-			expected = ftype.In(i)
+			expected = ftype.In(n)
 		}
 		if val == nil {
 			switch expected.Kind() {
 			case reflect.Chan, reflect.Func, reflect.Interface,
 				reflect.Map, reflect.Ptr, reflect.Slice:
 				// These types can be assigned 'nil'.
-				args[i] = reflect.Zero(expected)
+				args[n] = reflect.Zero(expected)
 			default:
 				panic(fmt.Errorf("jsontemplate: cannot pass nil as argument %d of %s, expecting %v", i+1, f.name, expected))
 			}
@@ -176,29 +717,86 @@ func (f function) interpolate(data interface{}, opt options) interface{} {
 			actual = pointer.Type()
 			rval = pointer
 		}
+		if l, ok := val.(Lambda); ok && expected.Kind() == reflect.Func && !actual.AssignableTo(expected) {
+			rval = l.adapt(expected)
+			actual = expected
+		}
 		if !actual.AssignableTo(expected) {
 			panic(fmt.Errorf("jsontemplate: cannot pass %v (%v) as argument %d of %s, expecting %v", val, reflect.TypeOf(val), i+1, f.name, expected))
 		}
-		args[i] = rval
+		args[n] = rval
 	}
 	// The parser should already have asserted that this is valid, yielding a
 	// nicer and earlier panic than we could do here, so no extra checks here.
 	return reflect.ValueOf(f.function).Call(args)[0].Interface()
 }
 
+// param is a parameter of a template, supplied when it is rendered.
+type param struct {
+	name         string
+	defaultValue template // Nil if the parameter is required.
+}
+
 // Template represents a transformation from one JSON-like structure to another.
+// A template can be rendered by several goroutines at once, as long as its
+// fields are not modified meanwhile.
 type Template struct {
 	definition template
+	params     []param
 
 	// MissingKeys defines the policy for how to handle keys referenced in
 	// queries that are absent in the input data. The default is to substitute
 	// them with null.
 	MissingKeys MissingKeyPolicy
+
+	// DuplicateKeys defines the policy for how to handle members generated with
+	// the same key in objects. The default is to keep the last one.
+	DuplicateKeys DuplicateKeyPolicy
+
+	// MaxDepth limits how deeply calls to definitions may be nested, which
+	// bounds the recursion when rendering tree-shaped input. The default is
+	// DefaultMaxDepth.
+	MaxDepth int
+
+	// UseNumber causes RenderJSON to decode numbers in the input as
+	// json.Number rather than float64, retaining their full precision.
+	UseNumber bool
+
+	// OrderedObjects causes Render to return objects as Object values, which
+	// keep their members in the order they are written in the template, rather
+	// than as maps. RenderJSON always keeps that order.
+	OrderedObjects bool
 }
 
 // Render generates a JSON-like structure based on the template definition,
 // using the passed `data` as source data for query expressions.
-func (t *Template) Render(data interface{}) (res interface{}, err error) {
+func (t *Template) Render(data interface{}) (interface{}, error) {
+	return t.RenderWithParams(data, nil)
+}
+
+// RenderContext works like Render, but stops with an error if the context is
+// done before the rendering is. The context is checked for each element of a
+// generator and each call to a definition, and passed to any function in the
+// FunctionMap taking a context.Context as its first parameter.
+func (t *Template) RenderContext(ctx context.Context, data interface{}) (interface{}, error) {
+	return t.RenderContextWithParams(ctx, data, nil)
+}
+
+// RenderWithParams works like Render, but also supplies the values of the
+// parameters declared in the template. It returns an error if a required
+// parameter is missing, or if a parameter is not declared in the template.
+func (t *Template) RenderWithParams(data interface{}, params map[string]interface{}) (interface{}, error) {
+	return t.RenderContextWithParams(context.Background(), data, params)
+}
+
+// RenderContextWithParams combines RenderContext and RenderWithParams.
+func (t *Template) RenderContextWithParams(ctx context.Context, data interface{}, params map[string]interface{}) (interface{}, error) {
+	return t.render(ctx, data, params, t.OrderedObjects)
+}
+
+// render works like RenderWithParams with a context, returning objects as
+// Object values if ordered is set.
+func (t *Template) render(ctx context.Context, data interface{}, params map[string]interface{}, ordered bool) (res interface{}, err error) {
 	// We handle errors in the recurstion using panics that stop here.
 	// This is similar to how the json library does it.
 	defer func() {
@@ -214,10 +812,42 @@ func (t *Template) Render(data interface{}) (res interface{}, err error) {
 			err = fmt.Errorf("jsontemplate: panic during interpolation: %v", r)
 		}
 	}()
-	res = t.definition.interpolate(data, options{MissingKeys: t.MissingKeys})
+	var opt = options{MissingKeys: t.MissingKeys, DuplicateKeys: t.DuplicateKeys, MaxDepth: t.MaxDepth, ctx: ctx}
+	opt.checkContext()
+	if ordered {
+		opt.order = keyOrder{}
+	}
+	opt = opt.bind(rootVariable, func() interface{} { return data })
+	var values = t.bindParams(data, params, opt)
+	opt = opt.bind(paramsVariable, func() interface{} { return values })
+	res = t.definition.interpolate(data, opt)
+	if ordered {
+		res = opt.order.ordered(res)
+	}
 	return
 }
 
+// bindParams returns the values of the parameters of the template, taken from
+// params or from their default values.
+func (t *Template) bindParams(data interface{}, params map[string]interface{}, opt options) map[string]interface{} {
+	var res = make(map[string]interface{}, len(t.params))
+	for _, p := range t.params {
+		if v, ok := params[p.name]; ok {
+			res[p.name] = v
+		} else if p.defaultValue != nil {
+			res[p.name] = p.defaultValue.interpolate(data, opt)
+		} else {
+			panic(fmt.Errorf("jsontemplate: missing required parameter %s", p.name))
+		}
+	}
+	for name := range params {
+		if _, ok := res[name]; !ok {
+			panic(fmt.Errorf("jsontemplate: unknown parameter %s", name))
+		}
+	}
+	return res
+}
+
 // RenderJSON generates JSON output based on the template definition, using JSON
 // input as source data for query expressions.
 //
@@ -229,7 +859,28 @@ func (t *Template) Render(data interface{}) (res interface{}, err error) {
 // If EOF is encountered on the input stream before the start of a JSON value,
 // RenderJSON will return io.EOF.
 func (t *Template) RenderJSON(out io.Writer, in io.Reader) error {
+	return t.RenderJSONWithParams(out, in, nil)
+}
+
+// RenderJSONContext works like RenderJSON, but with a context that can stop
+// the rendering, like RenderContext.
+func (t *Template) RenderJSONContext(ctx context.Context, out io.Writer, in io.Reader) error {
+	return t.RenderJSONContextWithParams(ctx, out, in, nil)
+}
+
+// RenderJSONWithParams works like RenderJSON, but also supplies the values of
+// the parameters declared in the template, like RenderWithParams.
+func (t *Template) RenderJSONWithParams(out io.Writer, in io.Reader, params map[string]interface{}) error {
+	return t.RenderJSONContextWithParams(context.Background(), out, in, params)
+}
+
+// RenderJSONContextWithParams combines RenderJSONContext and
+// RenderJSONWithParams.
+func (t *Template) RenderJSONContextWithParams(ctx context.Context, out io.Writer, in io.Reader, params map[string]interface{}) error {
 	var dec = json.NewDecoder(in)
+	if t.UseNumber {
+		dec.UseNumber()
+	}
 	var input interface{}
 	if err := dec.Decode(&input); err != nil {
 		if err == io.EOF {
@@ -237,7 +888,7 @@ func (t *Template) RenderJSON(out io.Writer, in io.Reader) error {
 		}
 		return fmt.Errorf("jsontemplate: invalid input: %v", err)
 	}
-	var output, err = t.Render(input)
+	var output, err = t.render(ctx, input, params, true)
 	if err != nil {
 		return err
 	}
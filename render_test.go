@@ -2,10 +2,14 @@ package jsontemplate
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -95,10 +99,11 @@ func Test_object_interpolate(t *testing.T) {
 		opt  options
 	}
 	tests := []struct {
-		name string
-		o    object
-		args args
-		want interface{}
+		name      string
+		o         object
+		args      args
+		want      interface{}
+		wantPanic bool
 	}{
 		{
 			name: "empty",
@@ -108,15 +113,113 @@ func Test_object_interpolate(t *testing.T) {
 		{
 			name: "simple",
 			o: object{
-				"x": field{value: numberConstant(123)},
+				field{key: "x", value: numberConstant(123)},
 			},
 			want: map[string]interface{}{
 				"x": float64(123),
 			},
 		},
+		{
+			name: "spread",
+			o: object{
+				field{key: "x", value: numberConstant(1)},
+				field{value: spread{query{expression: mustParseJSONPath("$")}}},
+				field{key: "z", value: numberConstant(3)},
+			},
+			args: args{
+				data: map[string]int{"x": 2, "y": 2, "z": 2},
+			},
+			want: map[string]interface{}{
+				"x": 2,
+				"y": 2,
+				"z": float64(3),
+			},
+		},
+		{
+			name: "spread null",
+			o: object{
+				field{value: spread{nullConstant{}}},
+			},
+			want: map[string]interface{}{},
+		},
+		{
+			name: "spread array",
+			o: object{
+				field{value: spread{array{}}},
+			},
+			wantPanic: true,
+		},
+		{
+			name: "computed key",
+			o: object{
+				field{key: "en", value: numberConstant(1)},
+				field{computedKey: query{expression: mustParseJSONPath("$.locale")}, value: numberConstant(2)},
+			},
+			args: args{
+				data: map[string]interface{}{"locale": "sv"},
+			},
+			want: map[string]interface{}{
+				"en": float64(1),
+				"sv": float64(2),
+			},
+		},
+		{
+			name: "computed key (duplicate, error)",
+			o: object{
+				field{key: "sv", value: numberConstant(1)},
+				field{computedKey: query{expression: mustParseJSONPath("$.locale")}, value: numberConstant(2)},
+			},
+			args: args{
+				data: map[string]interface{}{"locale": "sv"},
+				opt:  options{DuplicateKeys: ErrorOnDuplicate},
+			},
+			wantPanic: true,
+		},
+		{
+			name: "computed key (duplicate of later key, error)",
+			o: object{
+				field{computedKey: query{expression: mustParseJSONPath("$.locale")}, value: numberConstant(1)},
+				field{key: "sv", value: numberConstant(2)},
+			},
+			args: args{
+				data: map[string]interface{}{"locale": "sv"},
+				opt:  options{DuplicateKeys: ErrorOnDuplicate},
+			},
+			wantPanic: true,
+		},
+		{
+			name: "spread replacing key (error policy)",
+			o: object{
+				field{key: "x", value: numberConstant(1)},
+				field{value: spread{query{expression: mustParseJSONPath("$")}}},
+				field{key: "y", value: numberConstant(3)},
+			},
+			args: args{
+				data: map[string]int{"x": 2, "y": 2},
+				opt:  options{DuplicateKeys: ErrorOnDuplicate},
+			},
+			want: map[string]interface{}{
+				"x": 2,
+				"y": float64(3),
+			},
+		},
+		{
+			name: "computed key (non-string)",
+			o: object{
+				field{computedKey: numberConstant(1), value: numberConstant(2)},
+			},
+			wantPanic: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantPanic {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Errorf("object.interpolate() did not panic as expected")
+					}
+				}()
+			}
 			if got := tt.o.interpolate(tt.args.data, tt.args.opt); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("object.interpolate() = %v, want %v", got, tt.want)
 			}
@@ -126,9 +229,10 @@ func Test_object_interpolate(t *testing.T) {
 
 func Test_array_interpolate(t *testing.T) {
 	tests := []struct {
-		name string
-		a    array
-		want interface{}
+		name      string
+		a         array
+		want      interface{}
+		wantPanic bool
 	}{
 		{
 			name: "empty",
@@ -145,9 +249,33 @@ func Test_array_interpolate(t *testing.T) {
 			},
 			want: []interface{}{float64(1), float64(2), true, "foo"},
 		},
+		{
+			name: "spread",
+			a: array{
+				numberConstant(1),
+				spread{array{numberConstant(2), numberConstant(3)}},
+				spread{nullConstant{}},
+				numberConstant(4),
+			},
+			want: []interface{}{float64(1), float64(2), float64(3), float64(4)},
+		},
+		{
+			name: "spread object",
+			a: array{
+				spread{object{}},
+			},
+			wantPanic: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantPanic {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Errorf("array.interpolate() did not panic as expected")
+					}
+				}()
+			}
 			if got := tt.a.interpolate(nil, options{}); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("array.interpolate() = %v, want %v", got, tt.want)
 			}
@@ -287,6 +415,121 @@ func Test_generator_interpolate(t *testing.T) {
 			},
 			want: []interface{}{"foo", "bar", "baz"},
 		},
+		{
+			name: "variable",
+			g: generator{
+				over:     query{expression: mustParseJSONPath("$.outer[*]")},
+				variable: "x",
+				template: array{
+					query{variable: "x", expression: mustParseJSONPath("$.inner")},
+					query{expression: mustParseJSONPath("$.inner")},
+				},
+			},
+			args: args{
+				data: map[string]interface{}{
+					"outer": []interface{}{
+						map[string]interface{}{"inner": 1},
+						map[string]interface{}{"inner": 2},
+					},
+				},
+			},
+			want: []interface{}{
+				[]interface{}{1, 1},
+				[]interface{}{2, 2},
+			},
+		},
+		{
+			name: "index",
+			g: generator{
+				over:     query{expression: mustParseJSONPath("$[*]")},
+				key:      "i",
+				variable: "x",
+				template: array{query{variable: "i"}, query{variable: "x"}},
+			},
+			args: args{
+				data: []interface{}{"foo", "bar"},
+			},
+			want: []interface{}{
+				[]interface{}{float64(0), "foo"},
+				[]interface{}{float64(1), "bar"},
+			},
+		},
+		{
+			name: "object members",
+			g: generator{
+				over:     query{expression: mustParseJSONPath("$")},
+				key:      "k",
+				members:  true,
+				variable: "v",
+				template: array{query{variable: "k"}, query{variable: "v"}, query{expression: mustParseJSONPath("$")}},
+			},
+			args: args{
+				data: map[string]int{"b": 2, "c": 3, "a": 1},
+			},
+			want: []interface{}{
+				[]interface{}{"a", 1, 1},
+				[]interface{}{"b", 2, 2},
+				[]interface{}{"c", 3, 3},
+			},
+		},
+		{
+			name: "object without key",
+			g: generator{
+				over:     query{expression: mustParseJSONPath("$")},
+				variable: "v",
+				template: query{variable: "v"},
+			},
+			args: args{
+				data: map[string]int{"a": 1},
+			},
+			want: []interface{}{map[string]int{"a": 1}},
+		},
+		{
+			name: "object",
+			g: generator{
+				over:      query{expression: mustParseJSONPath("$[*]")},
+				memberKey: query{expression: mustParseJSONPath("$.id")},
+				template:  query{expression: mustParseJSONPath("$.v")},
+			},
+			args: args{
+				data: []interface{}{
+					map[string]interface{}{"id": "a", "v": 1},
+					map[string]interface{}{"id": "b", "v": 2},
+					map[string]interface{}{"id": "a", "v": 3},
+				},
+			},
+			want: map[string]interface{}{"a": 3, "b": 2},
+		},
+		{
+			name: "object (duplicate, error)",
+			g: generator{
+				over:      query{expression: mustParseJSONPath("$[*]")},
+				memberKey: query{expression: mustParseJSONPath("$.id")},
+				template:  query{expression: mustParseJSONPath("$.v")},
+			},
+			args: args{
+				data: []interface{}{
+					map[string]interface{}{"id": "a", "v": 1},
+					map[string]interface{}{"id": "a", "v": 3},
+				},
+				opt: options{DuplicateKeys: ErrorOnDuplicate},
+			},
+			wantPanic: true,
+		},
+		{
+			name: "object (non-string key)",
+			g: generator{
+				over:      query{expression: mustParseJSONPath("$[*]")},
+				memberKey: query{expression: mustParseJSONPath("$.v")},
+				template:  query{expression: mustParseJSONPath("$.v")},
+			},
+			args: args{
+				data: []interface{}{
+					map[string]interface{}{"id": "a", "v": 1},
+				},
+			},
+			wantPanic: true,
+		},
 		{
 			name: "search",
 			g: generator{
@@ -303,6 +546,118 @@ func Test_generator_interpolate(t *testing.T) {
 			},
 			want: []interface{}{"hello", "world"},
 		},
+		{
+			name: "group by",
+			g: generator{
+				over:     query{expression: mustParseJSONPath("$[*]")},
+				key:      "k",
+				groupBy:  query{expression: mustParseJSONPath("$.c")},
+				template: array{query{variable: "k"}, query{expression: mustParseJSONPath("$[*].v")}},
+			},
+			args: args{
+				data: []interface{}{
+					map[string]interface{}{"c": "b", "v": 1},
+					map[string]interface{}{"c": "a", "v": 2},
+					map[string]interface{}{"c": "b", "v": 3},
+					map[string]interface{}{"v": 4},
+				},
+			},
+			want: []interface{}{
+				[]interface{}{"b", []interface{}{1, 3}},
+				[]interface{}{"a", 2},
+				[]interface{}{nil, 4},
+			},
+		},
+		{
+			name: "where",
+			g: generator{
+				over:     query{expression: mustParseJSONPath("$[*]")},
+				where:    query{expression: mustParseJSONPath("$.ok")},
+				template: query{expression: mustParseJSONPath("$.v")},
+			},
+			args: args{
+				data: []interface{}{
+					map[string]interface{}{"ok": true, "v": 1},
+					map[string]interface{}{"ok": false, "v": 2},
+					map[string]interface{}{"v": 3},
+					map[string]interface{}{"ok": 0, "v": 4},
+				},
+			},
+			want: []interface{}{1, 4},
+		},
+		{
+			name: "order by (stable, multiple keys)",
+			g: generator{
+				over: query{expression: mustParseJSONPath("$[*]")},
+				orderBy: []ordering{
+					{key: query{expression: mustParseJSONPath("$.a")}},
+					{key: query{expression: mustParseJSONPath("$.b")}, descending: true},
+				},
+				template: query{expression: mustParseJSONPath("$.v")},
+			},
+			args: args{
+				data: []interface{}{
+					map[string]interface{}{"a": "y", "b": 1, "v": 1},
+					map[string]interface{}{"a": "x", "b": 1, "v": 2},
+					map[string]interface{}{"a": "y", "b": 2, "v": 3},
+					map[string]interface{}{"a": nil, "b": 1, "v": 4},
+					map[string]interface{}{"a": "x", "b": 1, "v": 5},
+				},
+			},
+			want: []interface{}{4, 2, 5, 3, 1},
+		},
+		{
+			name: "order by (mixed types)",
+			g: generator{
+				over:     query{expression: mustParseJSONPath("$[*]")},
+				orderBy:  []ordering{{key: query{expression: mustParseJSONPath("$")}}},
+				template: query{expression: mustParseJSONPath("$")},
+			},
+			args: args{
+				data: []interface{}{1, "a"},
+			},
+			wantPanic: true,
+		},
+		{
+			name: "limit and offset",
+			g: generator{
+				over:     query{expression: mustParseJSONPath("$.items[*]")},
+				limit:    query{expression: mustParseJSONPath("$.limit")},
+				offset:   numberConstant(1),
+				template: query{expression: mustParseJSONPath("$")},
+			},
+			args: args{
+				data: map[string]interface{}{
+					"items": []interface{}{1, 2, 3, 4},
+					"limit": 2,
+				},
+			},
+			want: []interface{}{2, 3},
+		},
+		{
+			name: "offset past end",
+			g: generator{
+				over:     query{expression: mustParseJSONPath("$[*]")},
+				offset:   numberConstant(5),
+				template: query{expression: mustParseJSONPath("$")},
+			},
+			args: args{
+				data: []interface{}{1, 2},
+			},
+			want: []interface{}{},
+		},
+		{
+			name: "negative limit",
+			g: generator{
+				over:     query{expression: mustParseJSONPath("$[*]")},
+				limit:    numberConstant(-1),
+				template: query{expression: mustParseJSONPath("$")},
+			},
+			args: args{
+				data: []interface{}{1, 2},
+			},
+			wantPanic: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -313,83 +668,355 @@ func Test_generator_interpolate(t *testing.T) {
 					}
 				}()
 			}
-			if got := tt.g.interpolate(tt.args.data, tt.args.opt); !reflect.DeepEqual(got, tt.want) {
+			var opt = tt.args.opt
+			opt.ctx = context.Background()
+			if got := tt.g.interpolate(tt.args.data, opt); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("generator.interpolate() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_function_interpolate(t *testing.T) {
-	var hello = func() string { return "hello" }
-	var fancy = func(n float64, np *float64, bs []byte, i interface{}, more ...interface{}) string { return "ok" }
+func Test_conditional_interpolate(t *testing.T) {
+	type args struct {
+		data interface{}
+		opt  options
+	}
 	tests := []struct {
 		name      string
-		f         function
+		c         conditional
+		args      args
 		want      interface{}
 		wantPanic bool
 	}{
 		{
-			name: "nullary",
-			f: function{
-				name:     "hello",
-				function: hello,
+			name: "true",
+			c: conditional{
+				condition: boolConstant(true),
+				then:      stringConstant("then"),
+				otherwise: stringConstant("else"),
 			},
-			want: "hello",
+			want: "then",
 		},
 		{
-			name: "binary",
-			f: function{
-				name:     "compare",
-				function: strings.Compare,
-				args: []template{
-					stringConstant("foo"),
-					stringConstant("bar"),
-				},
+			name: "false",
+			c: conditional{
+				condition: boolConstant(false),
+				then:      stringConstant("then"),
+				otherwise: stringConstant("else"),
 			},
-			want: 1,
+			want: "else",
 		},
 		{
-			name: "fancy",
-			f: function{
-				name:     "fancy",
-				function: fancy,
-				args: []template{
-					numberConstant(1),
-					nullConstant{},
-					nullConstant{},
-					nullConstant{},
-				},
+			name: "null",
+			c: conditional{
+				condition: nullConstant{},
+				then:      stringConstant("then"),
+				otherwise: stringConstant("else"),
 			},
-			want: "ok",
+			want: "else",
 		},
 		{
-			name: "null to float",
-			f: function{
-				name:     "fancy",
-				function: fancy,
-				args: []template{
-					nullConstant{},
-					nullConstant{},
-					nullConstant{},
-					nullConstant{},
-				},
+			name: "non-boolean",
+			c: conditional{
+				condition: numberConstant(0),
+				then:      stringConstant("then"),
+				otherwise: stringConstant("else"),
 			},
-			wantPanic: true,
+			want: "then",
 		},
 		{
-			name: "number to interface",
-			f: function{
-				name:     "fancy",
-				function: fancy,
-				args: []template{
-					numberConstant(1),
-					nullConstant{},
-					nullConstant{},
-					numberConstant(1),
-				},
+			name: "untaken branch is not evaluated",
+			c: conditional{
+				condition: query{expression: mustParseJSONPath("$.a")},
+				then:      query{expression: mustParseJSONPath("$.a")},
+				otherwise: query{expression: mustParseJSONPath("$.missing")},
 			},
-			want: "ok",
+			args: args{
+				data: map[string]interface{}{"a": "present"},
+				opt:  options{MissingKeys: ErrorOnMissing},
+			},
+			want: "present",
+		},
+		{
+			name: "missing condition",
+			c: conditional{
+				condition: query{expression: mustParseJSONPath("$.missing")},
+				then:      stringConstant("then"),
+				otherwise: stringConstant("else"),
+			},
+			args: args{
+				data: map[string]interface{}{"a": "present"},
+				opt:  options{MissingKeys: ErrorOnMissing},
+			},
+			wantPanic: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantPanic {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Errorf("conditional.interpolate() did not panic as expected")
+					}
+				}()
+			}
+			if got := tt.c.interpolate(tt.args.data, tt.args.opt); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("conditional.interpolate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_match_interpolate(t *testing.T) {
+	// Evaluating this panics, to test that only the matched arm is evaluated.
+	var fail = query{expression: mustParseJSONPath("$.missing")}
+	var opt = options{MissingKeys: ErrorOnMissing}
+	tests := []struct {
+		name      string
+		m         match
+		data      interface{}
+		want      interface{}
+		wantPanic bool
+	}{
+		{
+			name: "first arm",
+			m: match{
+				value:    query{expression: mustParseJSONPath("$.type")},
+				patterns: []template{stringConstant("created"), fail},
+				arms:     []template{numberConstant(1), fail},
+			},
+			data: map[string]interface{}{"type": "created"},
+			want: float64(1),
+		},
+		{
+			name: "equal numbers",
+			m: match{
+				value:    query{expression: mustParseJSONPath("$.type")},
+				patterns: []template{stringConstant("1"), numberConstant(1)},
+				arms:     []template{fail, stringConstant("number")},
+			},
+			data: map[string]interface{}{"type": 1},
+			want: "number",
+		},
+		{
+			name: "default",
+			m: match{
+				value:     query{expression: mustParseJSONPath("$.type")},
+				patterns:  []template{stringConstant("created")},
+				arms:      []template{fail},
+				otherwise: stringConstant("default"),
+			},
+			data: map[string]interface{}{"type": "deleted"},
+			want: "default",
+		},
+		{
+			name: "no match",
+			m: match{
+				value:    query{expression: mustParseJSONPath("$.type")},
+				patterns: []template{stringConstant("created")},
+				arms:     []template{numberConstant(1)},
+			},
+			data:      map[string]interface{}{"type": "deleted"},
+			wantPanic: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantPanic {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Errorf("match.interpolate() did not panic as expected")
+					}
+				}()
+			}
+			if got := tt.m.interpolate(tt.data, opt); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("match.interpolate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_let_interpolate(t *testing.T) {
+	var calls int
+	var count = function{
+		name: "count",
+		function: func() float64 {
+			calls++
+			return float64(calls)
+		},
+	}
+	tests := []struct {
+		name      string
+		l         let
+		data      interface{}
+		want      interface{}
+		wantCalls int
+	}{
+		{
+			name: "simple",
+			l: let{
+				names:  []string{"x"},
+				values: []template{query{expression: mustParseJSONPath("$.a")}},
+				body:   array{query{variable: "x"}, query{expression: mustParseJSONPath("$.b")}},
+			},
+			data: map[string]interface{}{"a": "first", "b": "second"},
+			want: []interface{}{"first", "second"},
+		},
+		{
+			name: "sequential",
+			l: let{
+				names: []string{"x", "y"},
+				values: []template{
+					query{expression: mustParseJSONPath("$.a")},
+					query{variable: "x", expression: mustParseJSONPath("$.b")},
+				},
+				body: query{variable: "y"},
+			},
+			data: map[string]interface{}{"a": map[string]interface{}{"b": 123}},
+			want: 123,
+		},
+		{
+			name: "evaluated once",
+			l: let{
+				names:  []string{"x"},
+				values: []template{count},
+				body:   array{query{variable: "x"}, query{variable: "x"}},
+			},
+			want:      []interface{}{float64(1), float64(1)},
+			wantCalls: 1,
+		},
+		{
+			name: "evaluated lazily",
+			l: let{
+				names:  []string{"x"},
+				values: []template{count},
+				body:   stringConstant("unused"),
+			},
+			want:      "unused",
+			wantCalls: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = 0
+			if got := tt.l.interpolate(tt.data, options{}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("let.interpolate() = %v, want %v", got, tt.want)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("let.interpolate() evaluated %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func Test_templateString_interpolate(t *testing.T) {
+	tests := []struct {
+		name string
+		s    templateString
+		want interface{}
+	}{
+		{
+			name: "constant",
+			s:    templateString{parts: []string{"foo"}},
+			want: "foo",
+		},
+		{
+			name: "formatting",
+			s: templateString{
+				parts: []string{"", " ", " ", " ", " ", " ", " ", ""},
+				values: []template{
+					stringConstant("text"),
+					numberConstant(123),
+					numberConstant(1.5),
+					boolConstant(true),
+					nullConstant{},
+					array{numberConstant(1), stringConstant("a")},
+					object{field{key: "a", value: numberConstant(1)}},
+				},
+			},
+			want: `text 123 1.5 true null [1,"a"] {"a":1}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.s.interpolate(nil, options{}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("templateString.interpolate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_function_interpolate(t *testing.T) {
+	var hello = func() string { return "hello" }
+	var fancy = func(n float64, np *float64, bs []byte, i interface{}, more ...interface{}) string { return "ok" }
+	tests := []struct {
+		name      string
+		f         function
+		want      interface{}
+		wantPanic bool
+	}{
+		{
+			name: "nullary",
+			f: function{
+				name:     "hello",
+				function: hello,
+			},
+			want: "hello",
+		},
+		{
+			name: "binary",
+			f: function{
+				name:     "compare",
+				function: strings.Compare,
+				args: []template{
+					stringConstant("foo"),
+					stringConstant("bar"),
+				},
+			},
+			want: 1,
+		},
+		{
+			name: "fancy",
+			f: function{
+				name:     "fancy",
+				function: fancy,
+				args: []template{
+					numberConstant(1),
+					nullConstant{},
+					nullConstant{},
+					nullConstant{},
+				},
+			},
+			want: "ok",
+		},
+		{
+			name: "null to float",
+			f: function{
+				name:     "fancy",
+				function: fancy,
+				args: []template{
+					nullConstant{},
+					nullConstant{},
+					nullConstant{},
+					nullConstant{},
+				},
+			},
+			wantPanic: true,
+		},
+		{
+			name: "number to interface",
+			f: function{
+				name:     "fancy",
+				function: fancy,
+				args: []template{
+					numberConstant(1),
+					nullConstant{},
+					nullConstant{},
+					numberConstant(1),
+				},
+			},
+			want: "ok",
 		},
 		{
 			name: "variadic",
@@ -476,11 +1103,53 @@ var testData = map[string]interface{}{
 
 func TestTemplate_Render(t *testing.T) {
 	var funcMap = map[string]interface{}{
-		"to_upper": strings.ToUpper,
+		"to_upper":    strings.ToUpper,
+		"trim_prefix": strings.TrimPrefix,
+		"map": func(elems []interface{}, f Lambda) []interface{} {
+			var res = make([]interface{}, len(elems))
+			for i, e := range elems {
+				res[i] = f(e)
+			}
+			return res
+		},
+		"filter": func(elems []interface{}, keep func(interface{}) bool) []interface{} {
+			var res []interface{}
+			for _, e := range elems {
+				if keep(e) {
+					res = append(res, e)
+				}
+			}
+			return res
+		},
+		"reduce": func(elems []interface{}, acc interface{}, f func(acc, elem interface{}) interface{}) interface{} {
+			for _, e := range elems {
+				acc = f(acc, e)
+			}
+			return acc
+		},
+		"set": func(m map[string]interface{}, key string, val interface{}) map[string]interface{} {
+			m[key] = val
+			return m
+		},
+		"delete": func(m map[string]interface{}, key string) map[string]interface{} {
+			delete(m, key)
+			return m
+		},
+	}
+	var tree = map[string]interface{}{
+		"name": "a",
+		"children": []interface{}{
+			map[string]interface{}{
+				"name":     "b",
+				"children": []interface{}{map[string]interface{}{"name": "c"}},
+			},
+		},
 	}
 	type args struct {
-		data interface{}
-		opt  options
+		data    interface{}
+		params  map[string]interface{}
+		opt     options
+		ordered bool
 	}
 	tests := []struct {
 		name       string
@@ -502,6 +1171,11 @@ func TestTemplate_Render(t *testing.T) {
 				"bar": []interface{}{float64(1), float64(2), float64(3)},
 			},
 		},
+		{
+			name:       "empty array and false",
+			definition: `[[], false]`,
+			wantRes:    []interface{}{[]interface{}{}, false},
+		},
 		{
 			name:       "query field",
 			definition: `$.number`,
@@ -544,6 +1218,404 @@ func TestTemplate_Render(t *testing.T) {
 			},
 			args: args{data: testData},
 		},
+		{
+			name: "conditional",
+			definition: `
+				{
+					"first": if $.bool then $.string else $.missing,
+					"second": if $.nil then $.missing else $.number
+				}
+			`,
+			wantRes: map[string]interface{}{
+				"first":  "hello world",
+				"second": 123,
+			},
+			args: args{
+				data: testData,
+				opt:  options{MissingKeys: ErrorOnMissing},
+			},
+		},
+		{
+			name: "let",
+			definition: `
+				let $first = $.nested.first, $a = $first.a in {
+					"a": $a,
+					"b": $first.b,
+					"objects": range $.array_of_objects[*] [ [$a, $.n] ]
+				}
+			`,
+			wantRes: map[string]interface{}{
+				"a": 123,
+				"b": true,
+				"objects": []interface{}{
+					[]interface{}{123, 123},
+					[]interface{}{123, 321},
+				},
+			},
+			args: args{data: testData},
+		},
+		{
+			name: "outer scopes",
+			definition: `
+				range $outer in $.array_of_objects[*] [
+					range $inner in $root.array[:2] [
+						[$outer.n, $inner, $, $root.number]
+					]
+				]
+			`,
+			wantRes: []interface{}{
+				[]interface{}{
+					[]interface{}{123, "text", "text", 123},
+					[]interface{}{123, 123, 123, 123},
+				},
+				[]interface{}{
+					[]interface{}{321, "text", "text", 123},
+					[]interface{}{321, 123, 123, 123},
+				},
+			},
+			args: args{data: testData},
+		},
+		{
+			name: "generator keys",
+			definition: `
+				{
+					"array": range $i, $x in $.array[*] [ { "index": $i, "value": $x } ],
+					"object": range $k, $v in $.object [ [$k, $v] ]
+				}
+			`,
+			wantRes: map[string]interface{}{
+				"array": []interface{}{
+					map[string]interface{}{"index": float64(0), "value": "text"},
+					map[string]interface{}{"index": float64(1), "value": 123},
+					map[string]interface{}{"index": float64(2), "value": true},
+					map[string]interface{}{"index": float64(3), "value": nil},
+				},
+				"object": []interface{}{
+					[]interface{}{"first", "hello"},
+					[]interface{}{"second", "world"},
+				},
+			},
+			args: args{data: testData},
+		},
+		{
+			name: "generator keys single element",
+			definition: `
+				{
+					"lines": range $i, $l in $.lines[*] [ { "pos": $i, "sku": $l.sku } ],
+					"first": range $k, $v in $.lines[0] [ $k ],
+				}
+			`,
+			wantRes: map[string]interface{}{
+				"lines": []interface{}{map[string]interface{}{"pos": float64(0), "sku": "a"}},
+				"first": []interface{}{"q", "sku"},
+			},
+			args: args{data: map[string]interface{}{
+				"lines": []interface{}{map[string]interface{}{"sku": "a", "q": float64(1)}},
+			}},
+		},
+		{
+			name:       "object generator",
+			definition: `range $i, $o in $.array_of_objects[*] { to_upper($.name): [$i, $.n] }`,
+			wantRes: map[string]interface{}{
+				"FIRST":  []interface{}{float64(0), 123},
+				"SECOND": []interface{}{float64(1), 321},
+			},
+			args: args{data: map[string]interface{}{
+				"array_of_objects": []interface{}{
+					map[string]interface{}{"name": "first", "n": 123},
+					map[string]interface{}{"name": "second", "n": 321},
+				},
+			}},
+		},
+		{
+			name: "spread",
+			definition: `
+				{
+					...$.object,
+					"second": "everyone",
+					"array": [...$.array[:2], ...$.missing, "more"]
+				}
+			`,
+			wantRes: map[string]interface{}{
+				"first":  "hello",
+				"second": "everyone",
+				"array":  []interface{}{"text", 123, "more"},
+			},
+			args: args{data: testData},
+		},
+		{
+			name:       "spread error",
+			definition: `[...$.object]`,
+			wantErr:    true,
+			args:       args{data: testData},
+		},
+		{
+			name:       "template string",
+			definition: "range $i, $o in $.array_of_objects[*] [`${$i}: ${to_upper($root.string)} \\`${$.n}\\``]",
+			wantRes:    []interface{}{"0: HELLO WORLD `123`", "1: HELLO WORLD `321`"},
+			args:       args{data: testData},
+		},
+		{
+			name: "arithmetic",
+			definition: `
+				{
+					"sum": range $i, $o in $.array_of_objects[*] [ ($i + 1) * 2 + $.n % 10 ],
+					"negative": -$.number - -1,
+				}
+			`,
+			wantRes: map[string]interface{}{
+				"sum":      []interface{}{float64(5), float64(5)},
+				"negative": float64(-122),
+			},
+			args: args{data: testData},
+		},
+		{
+			name:       "arithmetic error",
+			definition: `$.number + $.string`,
+			wantErr:    true,
+			args:       args{data: testData},
+		},
+		{
+			name: "comparison",
+			definition: `
+				{
+					"large": range $.array_of_objects[*] [ $.n > 200 && $.n <= 321 ],
+					"equal": $.object == {"second": "world", "first": "hello"},
+					"not": !$.nil || $.missing.key,
+				}
+			`,
+			wantRes: map[string]interface{}{
+				"large": []interface{}{false, true},
+				"equal": true,
+				"not":   true,
+			},
+			args: args{data: testData},
+		},
+		{
+			name:       "pipe",
+			definition: `[$.string | trim_prefix("hello ") | to_upper, $.object.first | to_upper()]`,
+			wantRes:    []interface{}{"WORLD", "HELLO"},
+			args:       args{data: testData},
+		},
+		{
+			name:       "coalesce",
+			definition: `[$.missing ?? $.nil ?? $.string, $.object.missing ?? 1, $.number ?? 2]`,
+			wantRes:    []interface{}{"hello world", float64(1), 123},
+			args:       args{data: testData, opt: options{MissingKeys: ErrorOnMissing}},
+		},
+		{
+			name:       "coalesce missing fallback",
+			definition: `$.nil ?? $.missing`,
+			wantErr:    true,
+			args:       args{data: testData, opt: options{MissingKeys: ErrorOnMissing}},
+		},
+		{
+			name: "definitions",
+			definition: `
+				def pair($key, $value) { "key": $key, "value": $value }
+				def countdown($n) if $n > 0 then [$n, ...countdown($n - 1)] else []
+				{
+					"pair": pair($.object.first, $.object.second | to_upper),
+					"countdown": countdown(3),
+				}
+			`,
+			wantRes: map[string]interface{}{
+				"pair":      map[string]interface{}{"key": "hello", "value": "WORLD"},
+				"countdown": []interface{}{float64(3), float64(2), float64(1)},
+			},
+			args: args{data: testData},
+		},
+		{
+			name: "recursion",
+			definition: `
+				def node($n) { "name": $n.name, "children": range $n.children[*] [ node($) ] }
+				node($)
+			`,
+			wantRes: map[string]interface{}{
+				"name": "a",
+				"children": []interface{}{
+					map[string]interface{}{
+						"name": "b",
+						"children": []interface{}{
+							map[string]interface{}{"name": "c", "children": []interface{}{}},
+						},
+					},
+				},
+			},
+			args: args{data: tree, opt: options{MaxDepth: 3}},
+		},
+		{
+			name: "recursion too deep",
+			definition: `
+				def node($n) { "name": $n.name, "children": range $n.children[*] [ node($) ] }
+				node($)
+			`,
+			wantErr: true,
+			args:    args{data: tree, opt: options{MaxDepth: 2}},
+		},
+		{
+			name:       "runaway recursion",
+			definition: `def forever($n) forever($n + 1) forever(0)`,
+			wantErr:    true,
+			args:       args{data: testData},
+		},
+		{
+			name:       "computed keys",
+			definition: `{[$.object.first]: 1, [$.string | to_upper]: $.object.second}`,
+			wantRes:    map[string]interface{}{"hello": float64(1), "HELLO WORLD": "world"},
+			args:       args{data: testData},
+		},
+		{
+			name: "group generator",
+			definition: `
+				group $b, $objects in $.nested.* by $.b {
+					` + "`b is ${$b}`" + `: range $objects[*] order by $.a [ $.a ]
+				}
+			`,
+			wantRes: map[string]interface{}{
+				"b is true": []interface{}{123, 321},
+			},
+			args: args{data: testData},
+		},
+		{
+			name: "generator clauses",
+			definition: `
+				range $i, $o in $.array_of_objects[*] where $i >= 0 order by $.n desc limit 1 [
+					{ "index": $i, "n": $o.n }
+				]
+			`,
+			wantRes: []interface{}{
+				map[string]interface{}{"index": float64(1), "n": 321},
+			},
+			args: args{data: testData},
+		},
+		{
+			name: "lambdas",
+			definition: `
+				let $factor = 2 in {
+					"map": map($.array_of_objects, $o => $o.n * $factor),
+					"filter": filter($.array, $x => $ != null && $ != true),
+					"reduce": reduce($.array_of_objects, 0, ($sum, $o) => $sum + $o.n),
+				}
+			`,
+			wantRes: map[string]interface{}{
+				"map":    []interface{}{float64(246), float64(642)},
+				"filter": []interface{}{"text", 123},
+				"reduce": float64(444),
+			},
+			args: args{data: testData},
+		},
+		{
+			name:       "lambda result type",
+			definition: `filter($.array, $x => 1)`,
+			wantErr:    true,
+			args:       args{data: testData},
+		},
+		{
+			name:       "lambda arguments",
+			definition: `map($.array, ($a, $b) => $a)`,
+			wantErr:    true,
+			args:       args{data: testData},
+		},
+		{
+			name: "match",
+			definition: `
+				range $.array[*] [
+					match $ { "text": "string", 123: "number", true: "bool", _: "other" }
+				]
+			`,
+			wantRes: []interface{}{"string", "number", "bool", "other"},
+			args:    args{data: testData},
+		},
+		{
+			name: "jsonpath keys",
+			definition: `
+				[$["content-type"], $.headers.x-request-id, $['first name'], $.städte, $["a.b"]['*']]
+			`,
+			wantRes: []interface{}{"json", float64(7), "Ada", float64(3), true},
+			args: args{data: map[string]interface{}{
+				"content-type": "json",
+				"headers":      map[string]interface{}{"x-request-id": float64(7)},
+				"first name":   "Ada",
+				"städte":       float64(3),
+				"a.b":          map[string]interface{}{"*": true},
+			}},
+		},
+		{
+			name:       "jsonpath root index",
+			definition: `[$[1], $[?(@.name == "a]b")].id]`,
+			wantRes:    []interface{}{"b", "a"},
+			args: args{data: []interface{}{
+				map[string]interface{}{"name": "a]b", "id": "a"},
+				"b",
+			}},
+		},
+		{
+			name: "params",
+			definition: `
+				param tenant
+				param locale = $.default_locale
+				def greeting() { "locale": $params.locale }
+				{ "tenant": $params.tenant, ...greeting() }
+			`,
+			wantRes: map[string]interface{}{"tenant": "acme", "locale": "sv"},
+			args: args{
+				data:   map[string]interface{}{"default_locale": "sv"},
+				params: map[string]interface{}{"tenant": "acme"},
+			},
+		},
+		{
+			name:       "params override defaults",
+			definition: `param locale = "en" $params.locale`,
+			wantRes:    "de",
+			args:       args{params: map[string]interface{}{"locale": "de"}},
+		},
+		{
+			name:       "missing param",
+			definition: `param tenant param locale = "en" $params.locale`,
+			wantErr:    true,
+			args:       args{params: map[string]interface{}{"locale": "de"}},
+		},
+		{
+			name:       "unknown param",
+			definition: `param tenant $params.tenant`,
+			wantErr:    true,
+			args:       args{params: map[string]interface{}{"tenant": "acme", "tennant": "acme"}},
+		},
+		{
+			name:       "ordered objects",
+			definition: `{"b": [{"d": 1, "c": $}], "a": {...$}}`,
+			wantRes: Object{
+				{Key: "b", Value: []interface{}{Object{{Key: "d", Value: float64(1)}, {Key: "c", Value: map[string]int{"f": 1}}}}},
+				{Key: "a", Value: Object{{Key: "f", Value: 1}}},
+			},
+			args: args{data: map[string]int{"f": 1}, ordered: true},
+		},
+		{
+			name:       "ordered objects everywhere",
+			definition: "let $o = {\"b\": 1, \"a\": 2} in [range $k, $v in $o [ $k ], {...$o}, `${$o}`]",
+			wantRes: []interface{}{
+				[]interface{}{"b", "a"},
+				Object{{Key: "b", Value: float64(1)}, {Key: "a", Value: float64(2)}},
+				`{"b":1,"a":2}`,
+			},
+			args: args{ordered: true},
+		},
+		{
+			name:       "ordered objects changed by functions",
+			definition: `[set(set({"b": 1, "a": 2}, "d", 4), "c", 3), {...delete({"b": 1, "a": 2}, "b"), "z": 0}]`,
+			wantRes: []interface{}{
+				Object{{Key: "b", Value: float64(1)}, {Key: "a", Value: float64(2)}, {Key: "c", Value: float64(3)}, {Key: "d", Value: float64(4)}},
+				Object{{Key: "a", Value: float64(2)}, {Key: "z", Value: float64(0)}},
+			},
+			args: args{ordered: true},
+		},
+		{
+			name:       "comparison error",
+			definition: `$.number < $.string`,
+			wantErr:    true,
+			args:       args{data: testData},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -552,13 +1624,15 @@ func TestTemplate_Render(t *testing.T) {
 				panic(fmt.Sprintf("broken test: %v", err))
 			}
 			templ.MissingKeys = tt.args.opt.MissingKeys
-			gotRes, err := templ.Render(tt.args.data)
+			templ.MaxDepth = tt.args.opt.MaxDepth
+			templ.OrderedObjects = tt.args.ordered
+			gotRes, err := templ.RenderWithParams(tt.args.data, tt.args.params)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("Template.Render() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("Template.RenderWithParams() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if !reflect.DeepEqual(gotRes, tt.wantRes) {
-				t.Errorf("Template.Render() = %v, want %v", gotRes, tt.wantRes)
+				t.Errorf("Template.RenderWithParams() = %v, want %v", gotRes, tt.wantRes)
 			}
 		})
 	}
@@ -567,11 +1641,20 @@ func TestTemplate_Render(t *testing.T) {
 func TestTemplate_RenderJSON(t *testing.T) {
 	var funcMap = map[string]interface{}{
 		"to_upper": strings.ToUpper,
+		"set": func(m map[string]interface{}, key string, val interface{}) map[string]interface{} {
+			m[key] = val
+			return m
+		},
+		"delete": func(m map[string]interface{}, key string) map[string]interface{} {
+			delete(m, key)
+			return m
+		},
 	}
 	tests := []struct {
 		name       string
 		definition string
 		input      string
+		useNumber  bool
 		wantOut    string
 		wantErr    bool
 	}{
@@ -597,7 +1680,60 @@ func TestTemplate_RenderJSON(t *testing.T) {
 					"string": "hello world"
 				}
 			`,
-			wantOut: `{"bar":[{"x":123},{"x":true},{"x":"A"}],"foo":["hello",3],"greeting":"HELLO WORLD"}`,
+			wantOut: `{"foo":["hello",3],"bar":[{"x":123},{"x":true},{"x":"A"}],"greeting":"HELLO WORLD"}`,
+		},
+		{
+			name:       "use number",
+			definition: `[$.big + 1, $.big * $.half, $.small]`,
+			input:      `{"big": 12345678901234567890123, "half": 0.5, "small": 9007199254740993}`,
+			useNumber:  true,
+			wantOut:    `[1.2345678901234568e+22,6.172839450617284e+21,9007199254740993]`,
+		},
+		{
+			name:       "fractions without leading zero",
+			definition: `{"x": .5, "y": -.5, "z": .5e1}`,
+			input:      `null`,
+			wantOut:    `{"x":0.5,"y":-0.5,"z":5}`,
+		},
+		{
+			name:       "exact integer literals",
+			definition: `[9007199254740993, 9007199254740993 + 2, 1.5e3]`,
+			input:      `null`,
+			wantOut:    `[9007199254740993,9007199254740995,1500]`,
+		},
+		{
+			name: "field order",
+			definition: `
+				let $extra = { "y": 1, "x": 2 } in {
+					"z": $.z,
+					[$.key]: 1,
+					...$extra,
+					"a": range $.items[*] { $.id: $.n },
+					"z": 0,
+					"input": $.input,
+				}
+			`,
+			input:   `{"z": true, "key": "m", "items": [{"id": "b", "n": 1}, {"id": "a", "n": 2}], "input": {"q": 1, "p": 2}}`,
+			wantOut: `{"z":0,"m":1,"y":1,"x":2,"a":{"b":1,"a":2},"input":{"p":2,"q":1}}`,
+		},
+		{
+			name:       "field order in generators and template strings",
+			definition: "let $o = {\"b\": 1, \"a\": 2} in [range $k, $v in $o [ $k ], {...$o}, `${$o}`]",
+			input:      `null`,
+			wantOut:    `[["b","a"],{"b":1,"a":2},"{\"b\":1,\"a\":2}"]`,
+		},
+		{
+			name:       "field order changed by functions",
+			definition: `{"o": set({"b": 1, "a": 2}, "c", 3), "p": delete({"b": 1, "a": 2}, "b")}`,
+			input:      `null`,
+			wantOut:    `{"o":{"b":1,"a":2,"c":3},"p":{"a":2}}`,
+		},
+		{
+			name:       "use number exact",
+			definition: `$.n * 2 - 1`,
+			input:      `{"n": 9007199254740993}`,
+			useNumber:  true,
+			wantOut:    `18014398509481985`,
 		},
 	}
 	for _, tt := range tests {
@@ -606,6 +1742,7 @@ func TestTemplate_RenderJSON(t *testing.T) {
 			if err != nil {
 				panic(fmt.Sprintf("broken test: %v", err))
 			}
+			templ.UseNumber = tt.useNumber
 			out := &bytes.Buffer{}
 			if err := templ.RenderJSON(out, strings.NewReader(tt.input)); (err != nil) != tt.wantErr {
 				t.Errorf("Template.RenderJSON() error = %v, wantErr %v", err, tt.wantErr)
@@ -625,3 +1762,184 @@ func ExampleTemplate_RenderJSON() {
 	os.Stdout.Sync()
 	// Output: {"CamelCase":123}
 }
+
+func TestTemplate_concurrent(t *testing.T) {
+	templ, err := ParseString(`
+		{
+			"names": range $x in $.items[*] where $x.n > 1 [ $x.name ],
+			"first": $.items[?(@.name == "a")].n,
+			"all": $..n,
+			"missing": $.items[0].missing ?? "none",
+		}
+	`, nil)
+	if err != nil {
+		t.Fatalf("ParseString() error = %v", err)
+	}
+	const input = `{"items": [{"name": "a", "n": 1}, {"name": "b", "n": 2}, {"name": "c", "n": 3}]}`
+	const want = `{"names":["b","c"],"first":1,"all":[1,2,3],"missing":"none"}`
+	var data interface{}
+	if err := json.Unmarshal([]byte(input), &data); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				var out bytes.Buffer
+				if err := templ.RenderJSON(&out, strings.NewReader(input)); err != nil {
+					t.Errorf("Template.RenderJSON() error = %v", err)
+				} else if got := strings.TrimSpace(out.String()); got != want {
+					t.Errorf("Template.RenderJSON() = %v, want %v", got, want)
+				}
+				if _, err := templ.Render(data); err != nil {
+					t.Errorf("Template.Render() error = %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTemplate_RenderContext(t *testing.T) {
+	type key struct{}
+	var cancel context.CancelFunc
+	var calls = 0
+	var funcMap = map[string]interface{}{
+		"tenant": func(ctx context.Context) interface{} { return ctx.Value(key{}) },
+		"greet":  func(ctx context.Context, name string) string { return ctx.Value(key{}).(string) + ": " + name },
+		"tick": func(ctx context.Context, n float64) float64 {
+			if calls++; n == 2 {
+				cancel()
+			}
+			return n
+		},
+	}
+	var data = map[string]interface{}{"name": "x", "items": []interface{}{1.0, 2.0, 3.0, 4.0}}
+	tests := []struct {
+		name       string
+		definition string
+		params     map[string]interface{}
+		canceled   bool
+		wantRes    interface{}
+		wantErr    error
+		wantCalls  int
+	}{
+		{
+			name:       "context passed",
+			definition: `[tenant(), $.name | greet]`,
+			wantRes:    []interface{}{"acme", "acme: x"},
+		},
+		{
+			name:       "context with params",
+			definition: `param who greet($params.who)`,
+			params:     map[string]interface{}{"who": "y"},
+			wantRes:    "acme: y",
+		},
+		{
+			name:       "cancel in generator",
+			definition: `range $.items[*] [ tick($) ]`,
+			wantErr:    context.Canceled,
+			wantCalls:  2,
+		},
+		{
+			// Canceled while evaluating the condition at depth 4, so the
+			// call at depth 5 is stopped before it evaluates its own.
+			name:       "cancel in recursion",
+			definition: `def f($n) if tick($n) > 0 then [f($n - 1)] else [] f(5)`,
+			wantErr:    context.Canceled,
+			wantCalls:  4,
+		},
+		{
+			name:       "already canceled",
+			definition: `$.name`,
+			canceled:   true,
+			wantErr:    context.Canceled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templ, err := ParseString(tt.definition, funcMap)
+			if err != nil {
+				panic(fmt.Sprintf("broken test: %v", err))
+			}
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.WithValue(context.Background(), key{}, "acme"))
+			defer cancel()
+			if tt.canceled {
+				cancel()
+			}
+			calls = 0
+			gotRes, err := templ.RenderContextWithParams(ctx, data, tt.params)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Template.RenderContextWithParams() error = %v, want %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(gotRes, tt.wantRes) || calls != tt.wantCalls {
+				t.Errorf("Template.RenderContextWithParams() = %v after %d calls, want %v after %d", gotRes, calls, tt.wantRes, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestTemplate_RenderJSONContext(t *testing.T) {
+	var cancel context.CancelFunc
+	var calls = 0
+	var funcMap = map[string]interface{}{
+		// done cancels the rendering when the recursion reaches depth $params.stop.
+		"done": func(ctx context.Context, n, stop float64) bool {
+			if calls++; n == stop {
+				cancel()
+			}
+			return n == 0
+		},
+	}
+	templ, err := ParseString(`
+		param stop = -1
+		def f($n) if done($n, $params.stop) then [] else [f($n - 1)]
+		f($.n)
+	`, funcMap)
+	if err != nil {
+		t.Fatalf("ParseString() error = %v", err)
+	}
+	tests := []struct {
+		name      string
+		input     string
+		params    map[string]interface{}
+		wantOut   string
+		wantErr   error
+		wantCalls int
+	}{
+		{
+			name:      "completed",
+			input:     `{"n": 2}`,
+			wantOut:   `[[[]]]`,
+			wantCalls: 3,
+		},
+		{
+			name:      "canceled",
+			input:     `{"n": 500}`,
+			params:    map[string]interface{}{"stop": float64(490)},
+			wantErr:   context.Canceled,
+			wantCalls: 11,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			defer cancel()
+			calls = 0
+			var out bytes.Buffer
+			err := templ.RenderJSONContextWithParams(ctx, &out, strings.NewReader(tt.input), tt.params)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Template.RenderJSONContextWithParams() error = %v, want %v", err, tt.wantErr)
+				return
+			}
+			if got := strings.TrimSpace(out.String()); got != tt.wantOut || calls != tt.wantCalls {
+				t.Errorf("Template.RenderJSONContextWithParams() = %v after %d calls, want %v after %d", got, calls, tt.wantOut, tt.wantCalls)
+			}
+		})
+	}
+}